@@ -0,0 +1,371 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/twpayne/go-kml"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	filepath2 "path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the map loaded with -append (nil if the map is not appended to another one)
+var appendMap *existingMap
+
+// features of a KML document that -append can replace
+var replaceableTags = []string{"Placemark", "PhotoOverlay", "Folder"}
+
+// links to files in a KML document: hrefs, gx:ImageUrls and img srcs in descriptions (also escaped)
+var kmlLinkRegexp = regexp.MustCompile(`(?:<href>|<gx:ImageUrl>|src=(?:"|'|&#34;|&quot;|&#39;|&apos;))\s*([^<>"'&]+)`)
+
+/*
+An existing KML or KMZ file the images are appended to (-append). The images are inserted as a new Folder
+at the end of its Document; everything else (styles, placemarks, ids) is kept as it is, byte for byte.
+ */
+type existingMap struct {
+	path       string
+	content    []byte          // the KML document
+	docEnd     int64           // offset of the end tag of the Document
+	features   []kmlFeature    // the features with an id (see replaceableTags)
+	files      []bundledFile   // the files of the map
+	zip        *zip.ReadCloser // the KMZ file (nil if the map is a KML file)
+	folderName string          // name of the folder of the new images
+	folderId   string
+	filesDir   string // the dir of the files of the new images (relative to the output directory)
+}
+
+/*
+A feature of the KML document with its position.
+ */
+type kmlFeature struct {
+	tag        string
+	id         string
+	start, end int64 // offsets of the element in the document
+}
+
+/*
+A file of the map: an entry of the KMZ file, or a file the KML file links to relative to its directory.
+ */
+type bundledFile struct {
+	name  string    // relative path in the map (slash separated)
+	entry *zip.File // the entry of the KMZ file (nil if the file is on the disk)
+	path  string    // path of the file on the disk
+}
+
+/*
+Loads the map to append to (-append) and puts the files of the new images into their own subdirectory
+of the files dir, so that they do not overwrite the files of the map.
+ */
+func setupAppend() error {
+	if appendFilepath == "" {
+		if appendFolder != "" {
+			return fmt.Errorf("-append-folder requires -append")
+		}
+		return nil
+	}
+	if update || watch {
+		return fmt.Errorf("-append cannot be used with -update or -watch")
+	}
+
+	m, err := loadExistingMap(normalizePath(appendFilepath))
+	if err != nil {
+		return inputError(err)
+	}
+	m.folderName = appendFolder
+	if m.folderName == "" {
+		m.folderName = name
+	}
+	if m.folderName == "" {
+		m.folderName = sources[0].label
+	}
+	h := sha256.Sum256([]byte(m.folderName))
+	m.folderId = fmt.Sprintf("folder-%x", h[:8])
+	m.filesDir = regexp.MustCompile(`[^A-Za-z0-9._-]+`).ReplaceAllString(m.folderName, "_")
+	if strings.Trim(m.filesDir, "._") == "" {
+		m.filesDir = "appended"
+	}
+	for _, src := range sources {
+		src.filesDir = joinPaths(m.filesDir, src.filesDir)
+	}
+	appendMap = m
+	return nil
+}
+
+/*
+Loads a KML file with the files it links to, or a KMZ file with its entries. The first KML file of a KMZ file
+is its document (as in Google Earth). The KMZ file stays open until the end.
+ */
+func loadExistingMap(file string) (*existingMap, error) {
+	m := &existingMap{path: file}
+	if strings.ToLower(filepath2.Ext(file)) == ".kmz" {
+		z, err := zip.OpenReader(file)
+		if err != nil {
+			return nil, err
+		}
+		addCleanup(func() {
+			z.Close()
+		})
+		m.zip = z
+		var doc *zip.File
+		for _, f := range z.File {
+			if f.FileInfo().IsDir() || !isRelativeLink(f.Name) {
+				continue
+			}
+			if doc == nil && strings.ToLower(path.Ext(f.Name)) == ".kml" {
+				doc = f
+			} else {
+				m.files = append(m.files, bundledFile{name: f.Name, entry: f})
+			}
+		}
+		if doc == nil {
+			return nil, fmt.Errorf("%s: there is no KML document in the KMZ file", file)
+		}
+		r, err := doc.Open()
+		if err != nil {
+			return nil, err
+		}
+		m.content, err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		m.content, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		m.files = findLinkedFiles(m.content, filepath2.Dir(file))
+	}
+
+	var err error
+	m.features, m.docEnd, err = scanKml(m.content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return m, nil
+}
+
+/*
+Returns the files in the dir the KML document links to by relative paths.
+ */
+func findLinkedFiles(content []byte, dir string) (files []bundledFile) {
+	found := map[string]bool{}
+	for _, match := range kmlLinkRegexp.FindAllSubmatch(content, -1) {
+		link := strings.TrimSpace(string(match[1]))
+		name, err := url.PathUnescape(link)
+		if err != nil || found[name] || !isRelativeLink(name) {
+			continue
+		}
+		found[name] = true
+		p := joinPaths(dir, filepath2.FromSlash(name))
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			files = append(files, bundledFile{name: name, path: p})
+		}
+	}
+	return files
+}
+
+/*
+Returns true if the link is a relative path inside the dir of the document (not a URL, an absolute path,
+an anchor or a path out of the dir).
+ */
+func isRelativeLink(link string) bool {
+	if link == "" || strings.Contains(link, ":") || strings.HasPrefix(link, "/") || strings.HasPrefix(link, "#") ||
+		strings.HasPrefix(link, `\`) {
+		return false
+	}
+	clean := path.Clean(link)
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+/*
+Finds the Document element and the features with an id (see replaceableTags) in the KML document.
+Returns the offset of the end tag of the Document.
+ */
+func scanKml(content []byte) (features []kmlFeature, docEnd int64, err error) {
+	dec := xml.NewDecoder(bytes.NewReader(content))
+	var open []kmlFeature
+	docEnd = -1
+	for {
+		start := dec.InputOffset()
+		token, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			f := kmlFeature{tag: t.Name.Local, start: start}
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "" && attr.Name.Local == "id" {
+					f.id = attr.Value
+				}
+			}
+			open = append(open, f)
+		case xml.EndElement:
+			f := open[len(open)-1]
+			open = open[:len(open)-1]
+			f.end = dec.InputOffset()
+			if f.tag == "Document" && len(open) == 1 && docEnd < 0 && f.end > start {
+				docEnd = start
+			}
+			if f.id != "" && containsString(replaceableTags, f.tag) {
+				features = append(features, f)
+			}
+		}
+	}
+	if docEnd < 0 {
+		return nil, 0, errors.New("there is no Document element in the KML document (or it is empty)")
+	}
+	sort.Slice(features, func(i, j int) bool {
+		return features[i].start < features[j].start
+	})
+	return features, docEnd, nil
+}
+
+/*
+Returns a new Folder for the images appended to the map.
+ */
+func (m *existingMap) newFolder() *kml.CompoundElement {
+	folder := kml.Folder(kml.Name(m.folderName))
+	folder.Attr = append(folder.Attr,
+		xml.Attr{Name: xml.Name{Local: "id"}, Value: m.folderId},
+		xml.Attr{Name: xml.Name{Local: "xmlns:gx"}, Value: "http://www.google.com/kml/ext/2.2"}, // the map may not declare it
+	)
+	return folder
+}
+
+/*
+Returns the KML document of the map with the folder inserted at the end of its Document. The placemarks
+of the same images (with the ids of the images) and the folder of a previous append with the same name
+are removed. Returns also the number of the replaced placemarks (outside the replaced folder) and whether
+the folder has been replaced.
+ */
+func (m *existingMap) merge(folder *kml.CompoundElement, images []*imagePlacemark) (content []byte, replaced int, folderReplaced bool, err error) {
+	ids := map[string]bool{}
+	for _, img := range images {
+		if img.hasLocation || includeNoLocation { // placed
+			ids[img.id] = true
+		}
+	}
+
+	var buf bytes.Buffer
+	var last int64 // end of the last removed feature
+	for _, f := range m.features {
+		isImage, isFolder := f.tag != "Folder" && ids[f.id], f.tag == "Folder" && f.id == m.folderId
+		if !isImage && !isFolder || f.start < last { // not replaced, or in a removed folder
+			continue
+		}
+		if isImage {
+			replaced++
+		} else {
+			folderReplaced = true
+		}
+		start := f.start
+		for start > last && (m.content[start-1] == ' ' || m.content[start-1] == '\t') {
+			start--
+		}
+		if start > last && m.content[start-1] == '\n' {
+			start--
+		}
+		buf.Write(m.content[last:start])
+		last = f.end
+	}
+
+	indent := m.docEnd
+	for indent > last && (m.content[indent-1] == ' ' || m.content[indent-1] == '\t') {
+		indent--
+	}
+	buf.Write(m.content[last:indent])
+	prefix := string(m.content[indent:m.docEnd])
+	enc := xml.NewEncoder(&buf) // without the XML declaration
+	enc.Indent(prefix+"  ", "  ")
+	if err := enc.Encode(folder); err != nil {
+		return nil, 0, false, err
+	}
+	buf.WriteString("\n" + prefix)
+	buf.Write(m.content[m.docEnd:])
+	return buf.Bytes(), replaced, folderReplaced, nil
+}
+
+/*
+Copies the files of the map that the merged document still links to into the output directory (unless -kmz-only)
+and adds them to the KMZ file (if it is not nil). The files in the dir of the new images are skipped, they belong
+to the replaced folder. Returns the copied files (relative to the output directory).
+ */
+func (m *existingMap) collectFiles(content []byte, kmzW *kmzWriter) (written []string, err error) {
+	for _, f := range m.files {
+		linked := bytes.Contains(content, []byte(f.name)) ||
+			bytes.Contains(content, []byte((&url.URL{Path: f.name}).EscapedPath()))
+		if !linked || f.name == "doc.kml" || strings.HasPrefix(f.name, joinPaths("files", m.filesDir)+"/") {
+			continue
+		}
+		dst := joinPaths(outDir, filepath2.FromSlash(f.name))
+		if !kmzOnly {
+			if f.entry != nil {
+				err = extractZipFile(f.entry, dst)
+			} else if absPath(f.path) != absPath(dst) { // the map can be in the output directory
+				err = copyFile(f.path, dst)
+			}
+			if err != nil {
+				return written, err
+			}
+			written = append(written, f.name)
+		}
+		if kmzW != nil {
+			if f.entry != nil {
+				err = addZipFile(kmzW, f.entry)
+			} else {
+				err = kmzW.addFile(f.name, f.path)
+			}
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+/*
+Writes the entry of a zip file into the file. Parent dirs are created if required.
+ */
+func extractZipFile(entry *zip.File, dst string) error {
+	r, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := createFile(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+/*
+Streams the entry of a zip file into the KMZ file under the same name.
+ */
+func addZipFile(kmzW *kmzWriter, entry *zip.File) error {
+	r, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return kmzW.addReader(entry.Name, r)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const appendTestKml = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2">
+  <Document>
+    <Style id="pin"><IconStyle><scale>2</scale></IconStyle></Style>
+    <Placemark id="photo-a"><name>a</name></Placemark>
+    <Folder id="folder-trip">
+      <name>Trip</name>
+      <Placemark id="photo-b"><name>b</name></Placemark>
+      <Placemark id="photo-c"><name>c</name></Placemark>
+    </Folder>
+    <Placemark id="home"><styleUrl>#pin</styleUrl></Placemark>
+  </Document>
+</kml>
+`
+
+/*
+Returns the map of the document, whose new images go into the folder "Trip".
+ */
+func newAppendTestMap(t *testing.T, content string) *existingMap {
+	features, docEnd, err := scanKml([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &existingMap{content: []byte(content), features: features, docEnd: docEnd, folderName: "Trip", folderId: "folder-trip"}
+}
+
+func TestMergeCounts(t *testing.T) {
+	images := []*imagePlacemark{
+		{id: "photo-a", hasLocation: true},
+		{id: "photo-b", hasLocation: true}, // in the replaced folder, not counted
+		{id: "photo-x", hasLocation: true}, // not in the map
+		{id: "home"},                       // not placed, so not replaced
+	}
+	m := newAppendTestMap(t, appendTestKml)
+	content, replaced, folderReplaced, err := m.merge(m.newFolder(), images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced != 1 || !folderReplaced {
+		t.Errorf("replaced %d, folder replaced %v; want 1, true", replaced, folderReplaced)
+	}
+	doc := string(content)
+	for _, removed := range []string{`id="photo-a"`, `id="photo-b"`, `id="photo-c"`} {
+		if strings.Contains(doc, removed) {
+			t.Errorf("%s is not removed:\n%s", removed, doc)
+		}
+	}
+	for _, kept := range []string{`<Style id="pin"><IconStyle><scale>2</scale></IconStyle></Style>`, `<Placemark id="home"><styleUrl>#pin</styleUrl></Placemark>`} {
+		if !strings.Contains(doc, kept) {
+			t.Errorf("%s is not kept:\n%s", kept, doc)
+		}
+	}
+	if n := strings.Count(doc, `<Folder id="folder-trip"`); n != 1 {
+		t.Errorf("%d folders, want 1:\n%s", n, doc)
+	}
+	if !strings.HasSuffix(doc, "  </Document>\n</kml>\n") {
+		t.Errorf("the end of the document is changed:\n%s", doc)
+	}
+
+	// appending again replaces only the folder
+	m = newAppendTestMap(t, doc)
+	_, replaced, folderReplaced, err = m.merge(m.newFolder(), images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced != 0 || !folderReplaced {
+		t.Errorf("again: replaced %d, folder replaced %v; want 0, true", replaced, folderReplaced)
+	}
+}
+
+func TestScanKmlWithoutDocument(t *testing.T) {
+	if _, _, err := scanKml([]byte(`<kml><Folder><name>x</name></Folder></kml>`)); err == nil {
+		t.Error("no error for a KML without Document")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	filepath2 "path/filepath"
+	"strings"
+)
+
+const defaultConfigFilename = "photo-map.yaml"
+
+var configPathFlags = []string{"i", "o", "data", "polygon", "watermark-logo", "path", "report", "append"}    // options with paths, relative to the config file
+var nonConfigFlags = []string{"h", "help", "config", "profile"} // options that cannot be set in the config file
+
+// structured options of the config file that are not flags, and their parsers
+var configSections = map[string]func(val interface{}, ctx configContext) error{
+	"privacy": parsePrivacyZones,
+}
+
+/*
+Where a config section is, used for resolving relative paths and for error messages.
+ */
+type configContext struct {
+	filepath  string        // the config file
+	positions dataPositions // positions of the config file
+	path      string        // path of the section in the config file, eg. "profiles.web.privacy"
+}
+
+/*
+Returns an error with the position of the value at the subpath of the section.
+ */
+func (ctx configContext) errorf(subpath string, format string, a ...interface{}) error {
+	path := ctx.path + subpath
+	for path != "" && ctx.positions[path].line == 0 { // fall back to the parent
+		if i := strings.LastIndexAny(path, ".["); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+	pos := ctx.positions[path]
+	return fmt.Errorf("%s:%d:%d: %s: %s", ctx.filepath, pos.line, pos.col, ctx.path+subpath, fmt.Sprintf(format, a...))
+}
+
+/*
+Returns the path relative to the config file (if it is not absolute).
+ */
+func (ctx configContext) resolvePath(path string) string {
+	if filepath2.IsAbs(path) {
+		return normalizePath(path)
+	}
+	return joinPaths(filepath2.Dir(ctx.filepath), path)
+}
+
+/*
+Loads the project configuration file (given by -config, or photo-map.yaml in the (first) input directory if it exists)
+and sets the options that have not been set on the command line. Options of the selected profile override
+the top-level ones. Any problem in the file produces fatal error.
+ */
+func loadConfig() {
+	path := configFilepath
+	if path == "" && len(imgSpecs) > 0 && sourceSpecDir(imgSpecs[0]) != "-" {
+		discovered := joinPaths(sourceSpecDir(imgSpecs[0]), defaultConfigFilename)
+		if _, err := os.Stat(discovered); err == nil {
+			path = discovered
+		}
+	}
+	if path == "" {
+		if profile != "" {
+			fatal(exitUsage, "A profile requires a configuration file: -config path/to/photo-map.yaml")
+		}
+		return
+	}
+	path = normalizePath(path)
+
+	var config dataObj
+	var positions dataPositions
+	var err error
+	switch strings.ToLower(filepath2.Ext(path)) {
+	case ".json":
+		config, positions, err = loadJson(path)
+	default:
+		config, positions, err = loadYaml(path)
+	}
+	fatalIfErr(err, exitUsage)
+	slog.Info("Using configuration file " + path)
+
+	setOnCmd := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setOnCmd[f.Name] = true
+	})
+
+	options := dataObj{}
+	for key, val := range config {
+		if key != "profiles" {
+			options[key] = val
+		}
+	}
+	optionPaths := map[string]string{} // option -> its path in the config file (for positions)
+	for key := range options {
+		optionPaths[key] = key
+	}
+
+	if profile != "" {
+		profiles, _ := config["profiles"].(dataObj)
+		profileOptions, ok := profiles[profile].(dataObj)
+		if !ok {
+			fatal(exitUsage, fmt.Sprintf("%s: cannot find profile %q (available: %s)", path, profile, strings.Join(sortedKeys(profiles), ", ")))
+		}
+		for key, val := range profileOptions {
+			options[key] = val
+			optionPaths[key] = joinDataPath("profiles", profile, key)
+		}
+	}
+
+	configDir := filepath2.Dir(path)
+	for _, key := range sortedKeys(options) {
+		pos := positions[optionPaths[key]]
+		if parse, ok := configSections[key]; ok {
+			fatalIfErr(parse(options[key], configContext{filepath: path, positions: positions, path: optionPaths[key]}), exitUsage)
+			continue
+		}
+		if flag.Lookup(key) == nil || containsString(nonConfigFlags, key) {
+			fatal(exitUsage, fmt.Sprintf("%s:%d:%d: unknown option %q", path, pos.line, pos.col, key))
+		}
+		if setOnCmd[key] {
+			continue
+		}
+
+		vals, ok := options[key].(dataArr) // repeatable options
+		if !ok {
+			vals = dataArr{options[key]}
+		}
+		for _, v := range vals {
+			val := fmt.Sprint(v)
+			if containsString(configPathFlags, key) {
+				val = resolveConfigPath(key, val, configDir)
+			}
+			if err := flag.Set(key, val); err != nil {
+				fatal(exitUsage, fmt.Sprintf("%s:%d:%d: invalid value of option %q: %s", path, pos.line, pos.col, key, err))
+			}
+		}
+	}
+}
+
+/*
+Makes the path in the value of the option relative to the config dir (if it is not absolute).
+The value of -i is a source specification, so only its directory is changed.
+ */
+func resolveConfigPath(key, val, configDir string) string {
+	rest := ""
+	if key == "i" {
+		dir := sourceSpecDir(val)
+		rest = strings.TrimPrefix(val, dir)
+		val = dir
+		if val == "-" {
+			return val + rest
+		}
+	}
+	if _, err := strconv.ParseBool(val); err == nil && key == "path" { // -path without a track file
+		return val
+	}
+	if !filepath2.IsAbs(val) {
+		val = joinPaths(configDir, val)
+	}
+	return val + rest
+}
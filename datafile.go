@@ -0,0 +1,437 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	filepath2 "path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// keys of a data file item and types of their values
+var dataItemKeys = map[string]string{
+	"file":       "string",
+	"external":   "string",
+	"dateTime":   "string",
+	"timeZone":   "string",
+	"latitude":   "number",
+	"longitude":  "number",
+	"altitude":   "number",
+	"properties": "object",
+	"icon":       "object",
+}
+
+/*
+A problem found in a data file.
+ */
+type dataProblem struct {
+	filepath string
+	pos      filePos
+	msg      string
+}
+
+func (p dataProblem) String() string {
+	if p.pos.line == 0 {
+		return fmt.Sprintf("%s: %s", p.filepath, p.msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", p.filepath, p.pos.line, p.pos.col, p.msg)
+}
+
+/*
+Loads JSON, YAML, CSV or TSV data file (based on the extension) and returns the data and positions of its keys and values.
+ */
+func loadDataFile(filepath string) (dataObj, dataPositions, error) {
+	switch strings.ToLower(filepath2.Ext(filepath)) {
+	case ".json":
+		return loadJson(filepath)
+	case ".yaml", ".yml":
+		return loadYaml(filepath)
+	case ".csv":
+		return loadCsv(filepath, ',')
+	case ".tsv":
+		return loadCsv(filepath, '\t')
+	}
+	return nil, nil, fmt.Errorf("unsupported data file format (use .json, .yaml, .yml, .csv or .tsv): %s", filepath)
+}
+
+/*
+A data file item (or the defaults) and the files it applies to.
+ */
+type dataRule struct {
+	data    dataObj
+	file    string         // normalized file path or pattern (empty if pure external image or defaults)
+	pattern *regexp.Regexp // nil if the file is an exact path
+	source  string         // where the rule is defined, eg. "data.yaml:12"
+}
+
+/*
+Returns true if the rule applies to the internal image with the (root-relative, normalized) path.
+ */
+func (r *dataRule) matches(path string) bool {
+	if r.pattern != nil {
+		return r.pattern.MatchString(path)
+	}
+	return r.file != "" && r.file == path
+}
+
+func (r *dataRule) String() string {
+	if r.file == "" {
+		return r.source
+	}
+	return fmt.Sprintf("%s (%s)", r.source, r.file)
+}
+
+/*
+Returns the defaults merged with all the rules that match the internal image path (in order, later rules override
+earlier ones), and the rules that have been used. Returns nil data if there is nothing to apply.
+ */
+func mergeMatchingRules(defaults *dataRule, rules []*dataRule, path string) (data dataObj, used []*dataRule) {
+	if defaults != nil {
+		used = append(used, defaults)
+	}
+	for _, rule := range rules {
+		if rule.matches(path) {
+			used = append(used, rule)
+		}
+	}
+	if len(used) == 0 {
+		return nil, nil
+	}
+
+	data = dataObj{}
+	for _, rule := range used {
+		mergeData(data, rule.data)
+	}
+	return data, used
+}
+
+/*
+Copies keys of the src object to the dst object. Properties are merged key by key.
+ */
+func mergeData(dst, src dataObj) {
+	for key, val := range src {
+		if dataItemKeys[key] == "object" { // properties and icon are merged key by key
+			props, _ := dst[key].(dataObj)
+			merged := dataObj{}
+			for k, v := range props {
+				merged[k] = v
+			}
+			for k, v := range val.(dataObj) {
+				merged[k] = v
+			}
+			dst[key] = merged
+		} else {
+			dst[key] = val
+		}
+	}
+}
+
+/*
+Returns true if the file of a data file item is a pattern (regex or glob) rather than an exact path.
+ */
+func isFilePattern(file string) bool {
+	return strings.HasPrefix(file, "regex:") || strings.ContainsAny(file, "*?[")
+}
+
+/*
+Returns true if the file of a data file item is a pattern. A glob that is the path of an image, e.g. "IMG[1].jpg",
+is the path (special characters can be also escaped by \).
+ */
+func (v *dataValidator) isPattern(file string) bool {
+	if strings.HasPrefix(file, "regex:") {
+		return true
+	}
+	return isFilePattern(file) && !v.isImageFile(normalizePath(file))
+}
+
+/*
+Compiles the file of a data file item: "regex:<expr>" is a regular expression, anything else is a glob.
+ */
+func compileFilePattern(file string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(file, "regex:") {
+		return regexp.Compile(strings.TrimPrefix(file, "regex:"))
+	}
+	return compileGlob(normalizePath(file))
+}
+
+/*
+Validator of a loaded data file. It collects the found problems.
+ */
+type dataValidator struct {
+	filepath   string
+	positions  dataPositions
+	sources    []*imageSource
+	problems   []dataProblem
+	imageFiles []string        // lazily listed images in the sources, see listImageFiles
+	imageSet   map[string]bool // ~ as a set
+}
+
+func (v *dataValidator) problem(path string, format string, a ...interface{}) {
+	v.problems = append(v.problems, dataProblem{filepath: v.filepath, pos: v.positions[path], msg: fmt.Sprintf(format, a...)})
+}
+
+/*
+Validates the loaded data file and returns its defaults (nil if there are none), rules (items) and all found problems.
+Items that are not objects or have an invalid 'file' are left out, and so are keys that are unknown or have invalid values;
+the returned rules are therefore safe to use.
+Files of the items are looked up in all the sources.
+Returns nil rules if there is no valid 'items' array.
+ */
+func validateDataFile(filepath string, data dataObj, positions dataPositions, sources []*imageSource) (defaults *dataRule, rules []*dataRule, problems []dataProblem) {
+	v := &dataValidator{filepath: filepath, positions: positions, sources: sources}
+	defer func() {
+		sort.SliceStable(v.problems, func(i, j int) bool {
+			return v.problems[i].pos.line < v.problems[j].pos.line
+		})
+		problems = v.problems
+	}()
+
+	for _, key := range sortedKeys(data) {
+		if key != "items" && key != "defaults" {
+			v.problem(key, "unknown key %q", key)
+		}
+	}
+
+	if rawDefaults, ok := data["defaults"]; ok {
+		if obj, ok := rawDefaults.(dataObj); ok {
+			defaults = &dataRule{
+				data:   v.validateObj(obj, "defaults"),
+				source: fmt.Sprintf("%s:%d (defaults)", filepath, positions["defaults"].line),
+			}
+		} else {
+			v.problem("defaults", "'defaults' has to be an object, got %s", dataTypeName(rawDefaults))
+		}
+	}
+
+	rawItems, ok := data["items"].(dataArr)
+	if !ok {
+		if data["items"] == nil {
+			v.problem("", "missing key 'items'")
+		} else {
+			v.problem("items", "'items' has to be an array, got %s", dataTypeName(data["items"]))
+		}
+		return defaults, nil, nil
+	}
+
+	rules = make([]*dataRule, 0, len(rawItems))
+	seen := map[string]string{} // file or external -> path of the first item
+	for i, rawItem := range rawItems {
+		itemPath := fmt.Sprintf("items[%d]", i)
+		obj, ok := rawItem.(dataObj)
+		if !ok {
+			v.problem(itemPath, "item has to be an object, got %s", dataTypeName(rawItem))
+			continue
+		}
+		item := v.validateObj(obj, itemPath)
+		rule := &dataRule{data: item, source: fmt.Sprintf("%s:%d", filepath, positions[itemPath].line)}
+
+		file, hasFile := item["file"].(string)
+		external, hasExternal := item["external"].(string)
+		if _, hadFile := obj["file"]; hadFile && !hasFile { // the problem with the file has been reported already
+			v.problem(itemPath, "item is skipped, its 'file' is invalid")
+			continue
+		}
+		id := ""
+		if hasFile {
+			rule.file = normalizePath(file)
+			if v.isPattern(file) {
+				rule.pattern, _ = compileFilePattern(file) // already checked
+				if strings.HasPrefix(file, "regex:") {
+					rule.file = file
+				}
+			}
+			id = rule.file
+			if rule.pattern != nil && hasExternal {
+				v.problem(joinDataPath(itemPath, "external"), "'external' cannot be used with a file pattern")
+				delete(item, "external")
+			}
+		} else if hasExternal {
+			id = external
+		} else {
+			if _, hadExternal := obj["external"]; !hadExternal { // otherwise it has been reported already
+				v.problem(itemPath, "item has neither 'file' nor 'external'")
+			}
+			continue
+		}
+		if first, ok := seen[id]; ok {
+			v.problem(itemPath, "duplicate entry for %q (first at line %d)", id, positions[first].line)
+		} else {
+			seen[id] = itemPath
+		}
+
+		rules = append(rules, rule)
+	}
+	return defaults, rules, nil
+}
+
+/*
+Validates keys and values of an item or the defaults (at the path) and returns a copy without the invalid ones.
+ */
+func (v *dataValidator) validateObj(obj dataObj, path string) dataObj {
+	valid := dataObj{}
+	for _, key := range sortedKeys(obj) {
+		keyPath := joinDataPath(path, key)
+		val := obj[key]
+
+		if !isKnownDataKey(key) {
+			v.problem(keyPath, "unknown key %q (custom values belong to 'properties')", key)
+			continue
+		}
+		if path == "defaults" && (key == "file" || key == "external") {
+			v.problem(keyPath, "%q cannot be used in 'defaults'", key)
+			continue
+		}
+		if t := dataTypeName(val); t != dataItemKeys[key] {
+			v.problem(keyPath, "%q has to be a %s, got %s", key, dataItemKeys[key], t)
+			continue
+		}
+		if msg := v.checkValue(key, val); msg != "" {
+			v.problem(keyPath, "%q: %s", key, msg)
+			continue
+		}
+		valid[key] = val
+	}
+
+	// do not place the image using only a half of the location
+	_, hasLat := valid["latitude"]
+	_, hasLon := valid["longitude"]
+	if _, ok := obj["latitude"]; ok && !hasLat {
+		delete(valid, "longitude")
+	}
+	if _, ok := obj["longitude"]; ok && !hasLon {
+		delete(valid, "latitude")
+	}
+	return valid
+}
+
+/*
+Checks the value of a known key (it has to have the right type already). Returns a description of the problem,
+or an empty string if the value is fine.
+ */
+func (v *dataValidator) checkValue(key string, val interface{}) string {
+	switch key {
+	case "file":
+		file := val.(string)
+		if v.isPattern(file) {
+			pattern, err := compileFilePattern(file)
+			if err != nil {
+				return fmt.Sprintf("invalid pattern: %s", err)
+			}
+			for _, path := range v.listImageFiles() {
+				if pattern.MatchString(path) {
+					return ""
+				}
+			}
+			return fmt.Sprintf("%s matches no image in %s", file, strings.Join(sourceDirs(v.sources), ", "))
+		}
+		if !v.isImageFile(normalizePath(file)) {
+			return fmt.Sprintf("%s is not an image in %s", file, strings.Join(sourceDirs(v.sources), ", "))
+		}
+	case "dateTime":
+		if _, err := time.Parse(exifTimeLayout, strings.Trim(val.(string), "\x00 ")); err != nil {
+			return fmt.Sprintf("%q does not match the format %q", val, exifTimeLayout)
+		}
+	case "timeZone":
+		if _, err := time.LoadLocation(val.(string)); err != nil {
+			return err.Error()
+		}
+	case "latitude":
+		if f, _ := getFloat64(val); f < -90 || f > 90 {
+			return fmt.Sprintf("%v is out of range [-90, 90]", val)
+		}
+	case "longitude":
+		if f, _ := getFloat64(val); f < -180 || f > 180 {
+			return fmt.Sprintf("%v is out of range [-180, 180]", val)
+		}
+	case "icon":
+		return checkIconOptions(val.(dataObj))
+	}
+	return ""
+}
+
+/*
+Returns root-relative paths of the images in the sources that are indexed (see listSourceImages), so that
+file patterns match the same images as in the build. The sources are listed only once.
+ */
+func (v *dataValidator) listImageFiles() []string {
+	if v.imageFiles != nil {
+		return v.imageFiles
+	}
+	v.imageFiles = []string{}
+	v.imageSet = map[string]bool{}
+	for _, src := range v.sources {
+		files, _ := listSourceImages(src) // the error is reported by the indexing
+		v.imageFiles = append(v.imageFiles, files...)
+	}
+	for _, path := range v.imageFiles {
+		v.imageSet[path] = true
+	}
+	return v.imageFiles
+}
+
+/*
+Returns true if the root-relative path is an image file in one of the sources, even if it is skipped
+(-include, -exclude, .photomapignore, hidden files), so that items for deliberately skipped images are not reported.
+ */
+func (v *dataValidator) isImageFile(path string) bool {
+	if v.listImageFiles(); v.imageSet[path] {
+		return true
+	}
+	for _, src := range v.sources {
+		if info, err := os.Stat(joinPaths(src.dir, path)); err == nil && info.Mode().IsRegular() && isImage(info) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns the name of the JSON/YAML type of the value.
+ */
+func dataTypeName(val interface{}) string {
+	switch val.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case dataObj:
+		return "object"
+	case dataArr:
+		return "array"
+	}
+	if _, err := getFloat64(val); err == nil {
+		return "number"
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+/*
+Returns true if the key is one of the dataItemKeys.
+ */
+func isKnownDataKey(key string) bool {
+	_, ok := dataItemKeys[key]
+	return ok
+}
+
+/*
+Returns true if the data file key holds a number.
+ */
+func isNumericDataKey(key string) bool {
+	return dataItemKeys[key] == "number"
+}
+
+/*
+Returns keys of the object in alphabetical order.
+ */
+func sortedKeys(obj dataObj) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const validationTestYaml = `items:
+  - file: a.jpg
+    latitude: 10
+  - file: missing.jpg
+    external: http://example.com/missing.jpg
+  - file: "*.png"
+  - latitude: 95
+    file: sub/b.jpg
+  - 5
+  - file: .hidden.jpg
+  - file: "*hidden*"
+defaults:
+  bogus: 1
+`
+
+func TestValidateDataFilePositions(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "data.yaml")
+	if err := ioutil.WriteFile(file, []byte(validationTestYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	photos := filepath.Join(dir, "photos")
+	// the hidden image is not indexed: patterns do not match it, but an item for it is not reported as missing
+	for _, f := range []string{"a.jpg", "sub/b.jpg", ".hidden.jpg"} {
+		writeTestFile(t, filepath.Join(photos, f), "")
+	}
+	data, positions, err := loadDataFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := []*imageSource{{dir: normalizePath(photos)}}
+	_, rules, problems := validateDataFile(file, data, positions, sources)
+
+	want := []string{
+		`4:5: "file": missing.jpg is not an image in photos`,
+		`4:5: item is skipped, its 'file' is invalid`,
+		`6:5: "file": *.png matches no image in photos`,
+		`6:5: item is skipped, its 'file' is invalid`,
+		`7:5: "latitude": 95 is out of range [-90, 90]`,
+		`9:5: item has to be an object, got number`,
+		`11:5: "file": *hidden* matches no image in photos`,
+		`11:5: item is skipped, its 'file' is invalid`,
+		`13:3: unknown key "bogus" (custom values belong to 'properties')`,
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, strings.ReplaceAll(strings.TrimPrefix(p.String(), file+":"), normalizePath(photos), "photos"))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the item with the invalid file is dropped, not turned into an external placemark
+	var files []string
+	for _, rule := range rules {
+		files = append(files, rule.file)
+		if _, ok := rule.data["latitude"]; ok && rule.file == "sub/b.jpg" {
+			t.Error("the invalid latitude is kept")
+		}
+	}
+	if strings.Join(files, ",") != "a.jpg,sub/b.jpg,.hidden.jpg" {
+		t.Errorf("rules for %v, want [a.jpg sub/b.jpg .hidden.jpg]", files)
+	}
+}
+
+/*
+Writes the file, creating its parent dirs.
+ */
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeMatchingRules(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"italy/day3/IMG_0042.jpg", "italy/day3/IMG_0043.jpg", "italy/IMG[1].jpg", "italy/IMG1.jpg"} {
+		writeTestFile(t, filepath.Join(dir, f), "")
+	}
+	data := dataObj{
+		"defaults": dataObj{"timeZone": "Europe/Rome", "properties": dataObj{"trip": "Italy", "day": "?"}},
+		"items": dataArr{
+			dataObj{"file": "italy/day3/*.jpg", "timeZone": "UTC", "properties": dataObj{"day": "3"}},
+			dataObj{"file": "italy/day3/IMG_0042.jpg", "latitude": 43.77, "longitude": 11.25},
+			dataObj{"file": "italy/IMG[1].jpg", "altitude": 100.0}, // the path, not a pattern
+			dataObj{"file": "regex:^italy/IMG", "properties": dataObj{"day": "1"}},
+		},
+	}
+	defaults, rules, problems := validateDataFile("data.json", data, dataPositions{}, []*imageSource{{dir: normalizePath(dir)}})
+	if len(problems) > 0 {
+		t.Fatalf("problems: %v", problems)
+	}
+
+	merged, used := mergeMatchingRules(defaults, rules, "italy/day3/IMG_0042.jpg")
+	if len(used) != 3 {
+		t.Errorf("%d rules used, want 3", len(used))
+	}
+	if merged["timeZone"] != "UTC" || merged["latitude"] != 43.77 {
+		t.Errorf("merged %v", merged)
+	}
+	if props := merged["properties"].(dataObj); props["trip"] != "Italy" || props["day"] != "3" {
+		t.Errorf("properties %v, want trip Italy and day 3", props)
+	}
+
+	merged, _ = mergeMatchingRules(defaults, rules, "italy/IMG1.jpg")
+	if _, ok := merged["altitude"]; ok {
+		t.Error("IMG[1].jpg is used as a pattern")
+	}
+	merged, _ = mergeMatchingRules(defaults, rules, "italy/IMG[1].jpg")
+	if merged["altitude"] != 100.0 || merged["timeZone"] != "Europe/Rome" || merged["properties"].(dataObj)["day"] != "1" {
+		t.Errorf("merged %v", merged)
+	}
+
+	if merged, used := mergeMatchingRules(nil, rules, "spain/a.jpg"); merged != nil || used != nil {
+		t.Errorf("merged %v for an image without rules", merged)
+	}
+}
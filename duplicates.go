@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+	"io"
+	"log/slog"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var duplicateModes = []string{"none", "report", "first", "sharpest", "collapse"}
+var duplicateHashes = []string{"dhash", "phash", "none"}
+
+var duplicateSampleSize = 256 // size of the downscaled image used for the perceptual hash and the sharpness
+
+/*
+What is compared to find duplicate images.
+ */
+type imageFingerprint struct {
+	content       [32]byte // SHA-256 of the file
+	perceptual    uint64   // dHash or pHash of the decoded image (see -duplicates-hash)
+	hasPerceptual bool
+	sharpness     float64 // variance of the Laplacian of the downscaled image
+}
+
+/*
+Checks the duplicate flags. Returns an error if any of them is invalid.
+ */
+func setupDuplicates() error {
+	if !containsString(duplicateModes, duplicatesMode) {
+		return fmt.Errorf("-duplicates has to be one of: %s", strings.Join(duplicateModes, ", "))
+	}
+	if !containsString(duplicateHashes, duplicatesHash) {
+		return fmt.Errorf("-duplicates-hash has to be one of: %s", strings.Join(duplicateHashes, ", "))
+	}
+	if duplicatesDistance < 0 || duplicatesDistance > 64 {
+		return fmt.Errorf("-duplicates-distance has to be between 0 and 64")
+	}
+	if duplicatesTime < 0 || duplicatesRadius < 0 {
+		return fmt.Errorf("-duplicates-time and -duplicates-radius cannot be negative")
+	}
+	return nil
+}
+
+/*
+Computes the content hash of the image file (during indexing). Nothing is done if duplicates are not detected.
+ */
+func (i *imagePlacemark) loadFingerprint(filepath string) error {
+	if duplicatesMode == "none" {
+		return nil
+	}
+	f, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	i.fingerprint = &imageFingerprint{}
+	copy(i.fingerprint.content[:], h.Sum(nil))
+	return nil
+}
+
+/*
+Decodes the images to compute their perceptual hashes and sharpness (if -duplicates needs them), before any files
+are written, so that no files are created for the duplicates that are not kept. Up-to-date images have them
+from the manifest. Images that cannot be decoded are reported and left out. Returns the other images.
+ */
+func computeFingerprints(images []*imagePlacemark) (fingerprinted []*imagePlacemark, failed int) {
+	if duplicatesMode == "none" || duplicatesHash == "none" && duplicatesMode != "sharpest" {
+		return images, 0
+	}
+	n := 0
+	for _, img := range images {
+		if img.fingerprint != nil && !img.upToDate {
+			n++
+		}
+	}
+	progress := startProgress("fingerprint", "Comparing images", "images", n)
+	defer progress.finish()
+	fingerprinted = make([]*imagePlacemark, 0, len(images))
+	for _, img := range images {
+		if img.fingerprint != nil && !img.upToDate {
+			progress.add(1)
+			decoded, err := imaging.Open(joinPaths(img.rootDir, img.path), imaging.AutoOrientation(true))
+			if err != nil {
+				img.fail(err, exitInput)
+				reportImage(img, "failed-decode")
+				failed++
+				continue
+			}
+			img.addImageFingerprint(decoded)
+		}
+		fingerprinted = append(fingerprinted, img)
+	}
+	return fingerprinted, failed
+}
+
+/*
+Computes the perceptual hash and the sharpness of the decoded image.
+ */
+func (i *imagePlacemark) addImageFingerprint(img image.Image) {
+	small := imaging.Grayscale(imaging.Fit(img, duplicateSampleSize, duplicateSampleSize, imaging.Box))
+	switch duplicatesHash {
+	case "dhash":
+		i.fingerprint.perceptual, i.fingerprint.hasPerceptual = dHash(small), true
+	case "phash":
+		i.fingerprint.perceptual, i.fingerprint.hasPerceptual = pHash(small), true
+	}
+	if duplicatesMode == "sharpest" {
+		i.fingerprint.sharpness = laplacianVariance(small)
+	}
+}
+
+/*
+Returns the difference hash: 64 bits, each telling whether a pixel of the image reduced to 9x8 is brighter
+than its right neighbor.
+ */
+func dHash(gray *image.NRGBA) uint64 {
+	small := imaging.Resize(gray, 9, 8, imaging.Box)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.Pix[small.PixOffset(x, y)] > small.Pix[small.PixOffset(x+1, y)] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+/*
+Returns the perceptual hash: 64 bits, each telling whether a low-frequency DCT coefficient of the image
+reduced to 32x32 is above the median.
+ */
+func pHash(gray *image.NRGBA) uint64 {
+	const n = 32
+	small := imaging.Resize(gray, n, n, imaging.Box)
+	var pixels [n][n]float64
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			pixels[y][x] = float64(small.Pix[small.PixOffset(x, y)])
+		}
+	}
+
+	var coefs []float64 // the 8x8 lowest frequencies
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for y := 0; y < n; y++ {
+				for x := 0; x < n; x++ {
+					sum += pixels[y][x] *
+						math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*n)) *
+						math.Cos(float64(2*y+1)*float64(v)*math.Pi/(2*n))
+				}
+			}
+			coefs = append(coefs, sum)
+		}
+	}
+
+	sorted := append([]float64(nil), coefs[1:]...) // without the DC coefficient (the average brightness)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	var hash uint64
+	for _, c := range coefs {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+/*
+Returns the variance of the Laplacian of the grayscale image; the higher, the sharper the image.
+ */
+func laplacianVariance(gray *image.NRGBA) float64 {
+	b := gray.Bounds()
+	at := func(x, y int) float64 {
+		return float64(gray.Pix[gray.PixOffset(x, y)])
+	}
+	var sum, sumSq float64
+	count := 0
+	for y := b.Min.Y + 1; y < b.Max.Y-1; y++ {
+		for x := b.Min.X + 1; x < b.Max.X-1; x++ {
+			l := at(x-1, y) + at(x+1, y) + at(x, y-1) + at(x, y+1) - 4*at(x, y)
+			sum += l
+			sumSq += l * l
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	mean := sum / float64(count)
+	return sumSq/float64(count) - mean*mean
+}
+
+/*
+Returns true if the images are near-duplicates: their perceptual hashes are similar, and they have been taken
+within -duplicates-time (images without a time do not match, unless it is 0) and -duplicates-radius
+(checked only if both images have a location).
+ */
+func (i *imagePlacemark) isSimilarTo(other *imagePlacemark) bool {
+	f, g := i.fingerprint, other.fingerprint
+	if !f.hasPerceptual || !g.hasPerceptual || bits.OnesCount64(f.perceptual^g.perceptual) > duplicatesDistance {
+		return false
+	}
+	if duplicatesTime > 0 {
+		if !i.hasDateTime || !other.hasDateTime {
+			return false
+		}
+		if dt := i.dateTime.Sub(other.dateTime); dt > duplicatesTime || dt < -duplicatesTime {
+			return false
+		}
+	}
+	if duplicatesRadius > 0 && i.hasLocation && other.hasLocation {
+		return distance(lonLat{i.longitude, i.latitude}, lonLat{other.longitude, other.latitude}) <= duplicatesRadius
+	}
+	return true
+}
+
+/*
+Returns the groups of duplicate images (in the order of the images, each group too). An image belongs to the group
+of the same file (by the content hash), or else to the first group whose first image it is similar to
+(see isSimilarTo); similarity is not transitive, so a chain of slightly different images is not one group.
+Only the groups with a first image of a similar hash are compared: the hash is split into distance+1 chunks,
+and similar hashes have at least one of them the same.
+ */
+func findDuplicates(images []*imagePlacemark) [][]*imagePlacemark {
+	var groups [][]*imagePlacemark
+	byContent := map[[32]byte]int{} // content hash -> group
+	chunks := duplicatesDistance + 1
+	var buckets []map[uint64][]int // chunk -> its value -> groups
+	if chunks <= 64 {
+		buckets = make([]map[uint64][]int, chunks)
+		for c := range buckets {
+			buckets[c] = map[uint64][]int{}
+		}
+	}
+	chunk := func(hash uint64, c int) uint64 {
+		from, to := c*64/chunks, (c+1)*64/chunks
+		return hash << from >> (64 - (to - from))
+	}
+
+	for _, img := range images {
+		f := img.fingerprint
+		if f == nil {
+			continue
+		}
+		group, ok := byContent[f.content]
+		if !ok && f.hasPerceptual {
+			group = -1
+			check := func(g int) {
+				if (group < 0 || g < group) && img.isSimilarTo(groups[g][0]) {
+					group = g
+				}
+			}
+			if buckets == nil { // any hashes can be similar
+				for g := range groups {
+					check(g)
+				}
+			} else {
+				for c, bucket := range buckets {
+					for _, g := range bucket[chunk(f.perceptual, c)] {
+						check(g)
+					}
+				}
+			}
+			ok = group >= 0
+		}
+		if ok {
+			groups[group] = append(groups[group], img)
+			if _, seen := byContent[f.content]; !seen { // its copies join without the checks
+				byContent[f.content] = group
+			}
+			continue
+		}
+
+		group = len(groups)
+		groups = append(groups, []*imagePlacemark{img})
+		byContent[f.content] = group
+		if f.hasPerceptual && buckets != nil {
+			for c, bucket := range buckets {
+				key := chunk(f.perceptual, c)
+				bucket[key] = append(bucket[key], group)
+			}
+		}
+	}
+
+	var duplicates [][]*imagePlacemark
+	for _, group := range groups {
+		if len(group) > 1 {
+			duplicates = append(duplicates, group)
+		}
+	}
+	return duplicates
+}
+
+/*
+Finds duplicate images and handles them according to -duplicates: reports them, keeps only the first or
+the sharpest image of each group, or collapses each group into its first image (placed with the others
+in one placemark, with the count in the icon badge). Images that are not kept get the filtered reason
+"duplicate", and they are counted in the filtered map. Returns the images to place and a summary.
+ */
+func handleDuplicates(images []*imagePlacemark, filtered map[string]int) ([]*imagePlacemark, string) {
+	if duplicatesMode == "none" {
+		return images, ""
+	}
+	groups := findDuplicates(images)
+
+	removed := map[*imagePlacemark]bool{}
+	for _, group := range groups {
+		kept := group[0]
+		if duplicatesMode == "sharpest" {
+			for _, img := range group[1:] {
+				if img.fingerprint.sharpness > kept.fingerprint.sharpness {
+					kept = img
+				}
+			}
+		}
+
+		files := make([]string, len(group))
+		for i, img := range group {
+			files[i] = img.displayName()
+		}
+		if duplicatesMode == "report" {
+			warn("Duplicates: " + strings.Join(files, ", "))
+			continue
+		}
+		slog.Info(fmt.Sprintf("Duplicates: %s (kept %s)", strings.Join(files, ", "), kept.displayName()))
+
+		for _, img := range group {
+			if img == kept {
+				continue
+			}
+			removed[img] = true
+			if duplicatesMode == "collapse" {
+				kept.duplicates = append(kept.duplicates, img)
+			} else {
+				img.filtered = "duplicate"
+				filtered[img.filtered]++
+				reportImage(img, "filtered")
+			}
+		}
+		kept.setCountBadge()
+	}
+
+	kept := make([]*imagePlacemark, 0, len(images)-len(removed))
+	for _, img := range images {
+		if !removed[img] {
+			kept = append(kept, img)
+		}
+	}
+
+	if len(groups) == 0 {
+		return kept, "no duplicates"
+	}
+	action := map[string]string{"report": "reported", "first": "skipped", "sharpest": "skipped", "collapse": "collapsed"}
+	n := 0
+	for _, group := range groups {
+		n += len(group) - 1
+	}
+	return kept, fmt.Sprintf("%d group(s) of duplicates, %d image(s) %s", len(groups), n, action[duplicatesMode])
+}
+
+/*
+Sets the count badge of the image with collapsed duplicates (-duplicates collapse): the number of its images,
+unless it has no internal icon or the data file sets its badge. The badge is drawn when the icon is created.
+ */
+func (i *imagePlacemark) setCountBadge() {
+	i.countBadge = ""
+	if len(i.duplicates) == 0 || !i.isIconInternal || i.iconStyle().badge != "" {
+		return
+	}
+	i.countBadge = strconv.Itoa(len(i.duplicates) + 1)
+	if len(i.duplicates)+1 > 99 {
+		i.countBadge = "99+"
+	}
+}
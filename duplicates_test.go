@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Returns an image with the content hash made from the content string and the perceptual hash.
+ */
+func duplicateTestImage(name, content string, perceptual uint64, minutes int) *imagePlacemark {
+	img := &imagePlacemark{origPath: name, externalPath: name, fingerprint: &imageFingerprint{perceptual: perceptual, hasPerceptual: true}}
+	copy(img.fingerprint.content[:], content)
+	if minutes >= 0 {
+		img.dateTime, img.hasDateTime = time.Date(2024, 6, 1, 8, minutes, 0, 0, time.UTC), true
+	}
+	return img
+}
+
+func formatGroups(groups [][]*imagePlacemark) string {
+	var s []string
+	for _, group := range groups {
+		var names []string
+		for _, img := range group {
+			names = append(names, img.origPath)
+		}
+		s = append(s, strings.Join(names, " "))
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestFindDuplicates(t *testing.T) {
+	defer func(distance int, dt time.Duration, radius float64) {
+		duplicatesDistance, duplicatesTime, duplicatesRadius = distance, dt, radius
+	}(duplicatesDistance, duplicatesTime, duplicatesRadius)
+	duplicatesDistance, duplicatesTime, duplicatesRadius = 2, 10*time.Minute, 100
+
+	images := []*imagePlacemark{
+		duplicateTestImage("a", "a", 0b0000, 0),
+		duplicateTestImage("a-copy", "a", 0xffff, 59), // the same file: ungated, whatever the hash and time
+		duplicateTestImage("b", "b", 0b0011, 1),       // 2 bits from a
+		duplicateTestImage("c", "c", 0b1111, 2),       // 2 bits from b, 4 from a: not transitive
+		duplicateTestImage("d", "d", 0b0001, 30),      // similar to a, but taken later
+		duplicateTestImage("e", "e", 0b0001, -1),      // no time
+		duplicateTestImage("c-copy", "c", 0, 0),
+		duplicateTestImage("f", "f", 0b1110, 3), // similar to c
+	}
+	images[5].fingerprint.content[1] = 1
+	images = append(images, &imagePlacemark{origPath: "external"}) // no fingerprint
+
+	want := "a a-copy b, c c-copy f"
+	if got := formatGroups(findDuplicates(images)); got != want {
+		t.Errorf("groups %q, want %q", got, want)
+	}
+
+	duplicatesTime = 0 // any time
+	want = "a a-copy b d e, c c-copy f"
+	if got := formatGroups(findDuplicates(images)); got != want {
+		t.Errorf("without the time check: groups %q, want %q", got, want)
+	}
+
+	// too far apart
+	images[2].latitude, images[2].longitude, images[2].hasLocation = 50, 14, true
+	images[0].latitude, images[0].longitude, images[0].hasLocation = 50.01, 14, true
+	want = "a a-copy d e, b c c-copy" // f is similar to c, but not to b
+	if got := formatGroups(findDuplicates(images)); got != want {
+		t.Errorf("with locations: groups %q, want %q", got, want)
+	}
+}
+
+func TestFindDuplicatesBuckets(t *testing.T) {
+	defer func(distance int, dt time.Duration) {
+		duplicatesDistance, duplicatesTime = distance, dt
+	}(duplicatesDistance, duplicatesTime)
+	duplicatesTime = 0
+
+	// every bit differs in another chunk, so the buckets have to find them all
+	for _, distance := range []int{0, 1, 6, 63, 64} {
+		duplicatesDistance = distance
+		var images []*imagePlacemark
+		base := uint64(0x0123456789abcdef)
+		images = append(images, duplicateTestImage("base", "base", base, 0))
+		for bit := 0; bit < 64; bit++ {
+			images = append(images, duplicateTestImage(fmt.Sprint(bit), fmt.Sprint(bit), base^1<<bit, 0))
+		}
+		groups := findDuplicates(images)
+		wantSize := 65
+		if distance == 0 {
+			wantSize = 0
+		}
+		size := 0
+		if len(groups) > 0 {
+			size = len(groups[0])
+		}
+		if size != wantSize {
+			t.Errorf("distance %d: the first group has %d images, want %d", distance, size, wantSize)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+	"os"
+	filepath2 "path/filepath"
+	"sort"
+	"strings"
+)
+
+var outputFormats = []string{"keep", "jpeg", "png"}
+var thumbnailFormats = []string{"png", "jpeg"}
+
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"mitchell":   imaging.MitchellNetravali,
+	"linear":     imaging.Linear,
+	"box":        imaging.Box,
+	"nearest":    imaging.NearestNeighbor,
+}
+
+var resampleFilter imaging.ResampleFilter // set in setupEncoding
+
+/*
+Checks the encoding flags. Returns an error if any of them is invalid.
+ */
+func setupEncoding() error {
+	if !containsString(outputFormats, outputFormat) {
+		return fmt.Errorf("-format has to be one of: %s", strings.Join(outputFormats, ", "))
+	}
+	if !containsString(thumbnailFormats, thumbFormat) {
+		return fmt.Errorf("-thumbformat has to be one of: %s", strings.Join(thumbnailFormats, ", "))
+	}
+	if jpegQuality < 1 || jpegQuality > 100 {
+		return fmt.Errorf("-quality has to be between 1 and 100")
+	}
+	if sharpenSigma < 0 {
+		return fmt.Errorf("-sharpen cannot be negative")
+	}
+	if imageMaxSize < 1 || iconMaxSize < 1 {
+		return fmt.Errorf("-maxsize and -thumbsize have to be positive")
+	}
+	var ok bool
+	resampleFilter, ok = resampleFilters[resampleName]
+	if !ok {
+		return fmt.Errorf("-resample has to be one of: %s", strings.Join(sortedFilterNames(), ", "))
+	}
+	return nil
+}
+
+/*
+Returns the names of the resample filters, sorted.
+ */
+func sortedFilterNames() []string {
+	names := make([]string, 0, len(resampleFilters))
+	for name := range resampleFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Returns the file extension (without a dot) used for the format.
+ */
+func formatExt(format string) string {
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+/*
+Returns true if the path has an extension of the format.
+ */
+func hasFormatExt(path, format string) bool {
+	mimeType, err := getImageMimeType(strings.TrimPrefix(filepath2.Ext(path), "."))
+	return err == nil && mimeType == "image/"+format
+}
+
+/*
+Returns the path of the resized image: the path of the original with the extension of -format appended
+if the format differs (e.g. "a.tif" -> "a.tif.jpg").
+ */
+func resizedImagePath(path string) string {
+	if outputFormat == "keep" || hasFormatExt(path, outputFormat) {
+		return path
+	}
+	return path + "." + formatExt(outputFormat)
+}
+
+/*
+Returns the path of the thumbnail of the image (root-relative), with the extension of -thumbformat.
+ */
+func thumbnailPath(rootRelPath string) string {
+	return joinPaths(".thumbnails", rootRelPath) + "." + formatExt(thumbFormat)
+}
+
+/*
+Resizes the image to fit into a maxSize x maxSize box using the -resample filter and sharpens it (-sharpen).
+ */
+func resizeImage(img image.Image, maxSize int) image.Image {
+	var resized image.Image = imaging.Fit(img, maxSize, maxSize, resampleFilter)
+	if sharpenSigma > 0 {
+		resized = imaging.Sharpen(resized, sharpenSigma)
+	}
+	return resized
+}
+
+/*
+Saves the image; the format is given by the extension of the path. Transparent images are put on a white
+background if the format is JPEG. JPEGs are progressive with -progressive (image/jpeg, used by imaging,
+writes only baseline ones).
+ */
+func saveImage(img image.Image, path string) error {
+	if hasFormatExt(path, "jpeg") {
+		if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+			img = flattenImage(img)
+		}
+		if progressiveJpeg {
+			return saveProgressiveJpeg(img, path)
+		}
+	}
+	return imaging.Save(img, path, imaging.JPEGQuality(jpegQuality))
+}
+
+/*
+Saves the image as a progressive JPEG (see encodeProgressiveJpeg).
+ */
+func saveProgressiveJpeg(img image.Image, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = encodeProgressiveJpeg(f, img, jpegQuality)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
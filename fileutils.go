@@ -4,13 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 	"io"
 	"io/ioutil"
 	"os"
 	filepath2 "path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -27,6 +30,19 @@ var imageMimeType = map[string]string {
 type dataObj = map[string]interface{}  // JSON or YAML object
 type dataArr = []interface{}  // JSON or YAML array
 
+/*
+Position in a data file. Both line and column start at 1; zero line means unknown position.
+ */
+type filePos struct {
+	line int
+	col  int
+}
+
+/*
+Positions of keys and values in a data file. Keys are paths like "items", "items[2]" or "items[2].latitude".
+ */
+type dataPositions = map[string]filePos
+
 /*
 Creates a directory with parent directories if required.
 */
@@ -86,6 +102,16 @@ func normalizePath(path string) string {
 	return filepath2.ToSlash(filepath2.Clean(path))
 }
 
+/*
+Returns the absolute normalized path (or the normalized path if it cannot be made absolute).
+ */
+func absPath(path string) string {
+	if abs, err := filepath2.Abs(path); err == nil {
+		return normalizePath(abs)
+	}
+	return normalizePath(path)
+}
+
 /*
 Joins paths using path/filepath.Join and normalizes and returns the result.
  */
@@ -107,29 +133,254 @@ func isImage(info os.FileInfo) bool {
 }
 
 /*
-Loads JSON file and returns the data
+Loads JSON file and returns the data and positions of its keys and values.
  */
-func loadJson(filepath string) (data dataObj, err error) {
-	bytes, err := ioutil.ReadFile(filepath)
+func loadJson(filepath string) (data dataObj, positions dataPositions, err error) {
+	content, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(bytes, &data)
-	return
+
+	positions = dataPositions{}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	val, err := decodeJsonValue(dec, content, "", positions)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			pos := offsetToPos(content, syntaxErr.Offset)
+			return nil, nil, fmt.Errorf("%s:%d:%d: %w", filepath, pos.line, pos.col, err)
+		}
+		return nil, nil, fmt.Errorf("%s: %w", filepath, err)
+	}
+
+	data, ok := val.(dataObj)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: the top-level value has to be an object", filepath)
+	}
+	return data, positions, nil
+}
+
+/*
+Decodes the next JSON value from the decoder (the same way json.Unmarshal would) and records positions of object keys
+and array elements.
+ */
+func decodeJsonValue(dec *json.Decoder, content []byte, path string, positions dataPositions) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		obj := dataObj{}
+		for dec.More() {
+			pos := offsetToPos(content, nextTokenOffset(content, dec.InputOffset()))
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := keyTok.(string) // object keys are always strings
+			keyPath := joinDataPath(path, key)
+			positions[keyPath] = pos
+			obj[key], err = decodeJsonValue(dec, content, keyPath, positions)
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = dec.Token() // }
+		return obj, err
+
+	case json.Delim('['):
+		arr := dataArr{}
+		for i := 0; dec.More(); i++ {
+			elPath := fmt.Sprintf("%s[%d]", path, i)
+			positions[elPath] = offsetToPos(content, nextTokenOffset(content, dec.InputOffset()))
+			val, err := decodeJsonValue(dec, content, elPath, positions)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, val)
+		}
+		_, err = dec.Token() // ]
+		return arr, err
+	}
+
+	return tok, nil
 }
 
 /*
-Loads YAML file and returns the data
+Returns offset of the next JSON token, skipping whitespace and separators.
  */
-func loadYaml(filepath string) (data dataObj, err error) {
-	bytes, err := ioutil.ReadFile(filepath)
+func nextTokenOffset(content []byte, offset int64) int64 {
+	for offset < int64(len(content)) && strings.IndexByte(" \t\r\n,:", content[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+/*
+Converts a byte offset to line and column.
+ */
+func offsetToPos(content []byte, offset int64) filePos {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return filePos{line: line, col: col}
+}
+
+/*
+Loads YAML file and returns the data and positions of its keys and values.
+ */
+func loadYaml(filepath string) (data dataObj, positions dataPositions, err error) {
+	content, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		return
 	}
-	var yamlData map[interface{}]interface{}
-	err = yaml.Unmarshal(bytes, &yamlData)
-	data = convertYamlToJsonObj(yamlData).(dataObj)
-	return
+
+	var root yaml.Node
+	err = yaml.Unmarshal(content, &root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filepath, err)
+	}
+	positions = dataPositions{}
+	if len(root.Content) == 0 { // empty file
+		return dataObj{}, positions, nil
+	}
+
+	var yamlData interface{}
+	err = root.Decode(&yamlData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filepath, err)
+	}
+	data, ok := convertYamlToJsonObj(yamlData).(dataObj)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: the top-level value has to be an object", filepath)
+	}
+
+	collectYamlPositions(root.Content[0], "", positions)
+	return data, positions, nil
+}
+
+/*
+Records positions of mapping keys and sequence elements of the YAML node and its children.
+ */
+func collectYamlPositions(node *yaml.Node, path string, positions dataPositions) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			keyPath := joinDataPath(path, key.Value)
+			positions[keyPath] = filePos{line: key.Line, col: key.Column}
+			collectYamlPositions(node.Content[i+1], keyPath, positions)
+		}
+	case yaml.SequenceNode:
+		for i, el := range node.Content {
+			elPath := fmt.Sprintf("%s[%d]", path, i)
+			positions[elPath] = filePos{line: el.Line, col: el.Column}
+			collectYamlPositions(el, elPath, positions)
+		}
+	}
+}
+
+/*
+Loads CSV (or TSV, depending on the separator) file and returns the data in the same structure as loadJson does,
+and positions of the items (rows) and their keys (cells).
+The first row is a header with the keys; each other row is one item. Empty cells are left out of the item.
+Values in number columns are parsed as numbers, other values are kept as strings.
+Columns that are not in dataItemKeys are put into the item's "properties" object.
+ */
+func loadCsv(filepath string, separator rune) (data dataObj, positions dataPositions, err error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.Comma = separator
+	r.TrimLeadingSpace = separator != '\t' // a tab is a space too: it would merge the empty cells of a TSV file
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("%s: missing header row", filepath)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filepath, err)
+	}
+	for col, key := range header {
+		header[col] = strings.TrimSpace(strings.TrimPrefix(key, "\ufeff")) // strip BOM written by spreadsheet apps
+		if header[col] == "" {
+			return nil, nil, fmt.Errorf("%s: row 1, column %d: empty key in the header", filepath, col+1)
+		}
+		if header[col] == "properties" {
+			return nil, nil, fmt.Errorf("%s: row 1, column %d: use the property names as columns instead of 'properties'", filepath, col+1)
+		}
+	}
+
+	positions = dataPositions{"items": {line: 1, col: 1}}
+	items := dataArr{}
+	for row := 2; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", filepath, err)
+		}
+
+		itemPath := fmt.Sprintf("items[%d]", len(items))
+		item := dataObj{}
+		for col, val := range record {
+			val = strings.TrimSpace(val)
+			if val == "" {
+				continue
+			}
+			key := header[col]
+			pos := filePos{line: row, col: col + 1}
+			if !isKnownDataKey(key) {
+				if item["properties"] == nil {
+					item["properties"] = dataObj{}
+				}
+				item["properties"].(dataObj)[key] = val
+				positions[joinDataPath(itemPath, "properties", key)] = pos
+			} else if isNumericDataKey(key) {
+				float, err := strconv.ParseFloat(val, 64)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s: row %d, column %d (%s): %q is not a number", filepath, row, col+1, key, val)
+				}
+				item[key] = float
+				positions[joinDataPath(itemPath, key)] = pos
+			} else {
+				item[key] = val
+				positions[joinDataPath(itemPath, key)] = pos
+			}
+		}
+		if len(item) > 0 {
+			positions[itemPath] = filePos{line: row, col: 1}
+			items = append(items, item)
+		}
+	}
+
+	return dataObj{"items": items}, positions, nil
+}
+
+/*
+Joins data path elements (object keys) with dots.
+ */
+func joinDataPath(path string, keys ...string) string {
+	for _, key := range keys {
+		if path == "" {
+			path = key
+		} else {
+			path += "." + key
+		}
+	}
+	return path
 }
 
 /*
@@ -141,9 +392,13 @@ func convertYamlToJsonObj(yamlInt interface{}) interface{} {
 	case map[interface{}]interface{}:
 		strmap := map[string]interface{}{}
 		for key, val := range x {
-			strmap[key.(string)] = convertYamlToJsonObj(val)
+			strmap[fmt.Sprint(key)] = convertYamlToJsonObj(val)
 		}
 		return strmap
+	case map[string]interface{}:
+		for key, val := range x {
+			x[key] = convertYamlToJsonObj(val)
+		}
 	case []interface{}:
 		for i, val := range x {
 			x[i] = convertYamlToJsonObj(val)
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoadCsvTsvWithEmptyCells(t *testing.T) {
+	data, _, err := loadCsv("testdata/empty-column.tsv", '\t')
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dataObj{"items": dataArr{
+		dataObj{"file": "a.jpg", "longitude": 14.1, "properties": dataObj{"camera": "x"}},
+		dataObj{"file": "b.jpg", "latitude": 50.2},
+	}}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("got %v, want %v", data, want)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// filters (set in setupFilters)
+var filterFrom time.Time
+var filterTo time.Time
+var filterBbox *bbox
+var filterPolygons []polygon
+
+// layouts accepted by -from and -to; the ones without time cover the whole day
+var filterTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+/*
+Parses the filter flags. Returns an error if any of them is invalid.
+ */
+func setupFilters() error {
+	var err error
+	if fromStr != "" {
+		filterFrom, _, err = parseFilterTime(fromStr)
+		if err != nil {
+			return fmt.Errorf("-from: %w", err)
+		}
+	}
+	if toStr != "" {
+		var wholeDay bool
+		filterTo, wholeDay, err = parseFilterTime(toStr)
+		if err != nil {
+			return fmt.Errorf("-to: %w", err)
+		}
+		if wholeDay {
+			filterTo = filterTo.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+	}
+	if bboxStr != "" {
+		b, err := parseBbox(bboxStr)
+		if err != nil {
+			return fmt.Errorf("-bbox: %w", err)
+		}
+		filterBbox = &b
+	}
+	if polygonFilepath != "" {
+		filterPolygons, err = loadGeoJsonPolygons(normalizePath(polygonFilepath))
+		if err != nil {
+			return inputError(fmt.Errorf("-polygon: %w", err))
+		}
+	}
+	return nil
+}
+
+/*
+Parses time of -from or -to in the local time zone. wholeDay is true if only the date is given.
+ */
+func parseFilterTime(s string) (t time.Time, wholeDay bool, err error) {
+	for _, layout := range filterTimeLayouts {
+		t, err = time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t, layout == "2006-01-02", nil
+		}
+	}
+	return t, false, fmt.Errorf("cannot parse %q (use e.g. 2006-01-02 or 2006-01-02 15:04:05)", s)
+}
+
+/*
+Returns true if rating or keywords of the images have to be loaded.
+ */
+func needsRatingAndKeywords() bool {
+	return minRating > 0 || len(requiredKeywords) > 0 || len(excludedKeywords) > 0
+}
+
+/*
+Returns the reason why the image is filtered out, or an empty string if it passes all the filters.
+ */
+func filterReason(img *imagePlacemark) string {
+	if img.privacyZone != nil && img.privacyZone.action == "drop" {
+		return "privacy"
+	}
+
+	if !filterFrom.IsZero() || !filterTo.IsZero() {
+		if !img.hasDateTime {
+			return "date"
+		}
+		if !filterFrom.IsZero() && img.dateTime.Before(filterFrom) || !filterTo.IsZero() && img.dateTime.After(filterTo) {
+			return "date"
+		}
+	}
+
+	if filterBbox != nil || filterPolygons != nil {
+		p := lonLat{img.longitude, img.latitude}
+		if !img.hasLocation {
+			return "location"
+		}
+		if filterBbox != nil && !filterBbox.contains(p) || filterPolygons != nil && !anyPolygonContains(filterPolygons, p) {
+			return "location"
+		}
+	}
+
+	if minRating > 0 && (!img.hasRating || img.rating < minRating) {
+		return "rating"
+	}
+
+	for _, k := range requiredKeywords {
+		if !hasKeyword(img, k) {
+			return "keywords"
+		}
+	}
+	for _, k := range excludedKeywords {
+		if hasKeyword(img, k) {
+			return "keywords"
+		}
+	}
+	return ""
+}
+
+/*
+Returns true if the image has the keyword (case insensitive).
+ */
+func hasKeyword(img *imagePlacemark, keyword string) bool {
+	for _, k := range img.keywords {
+		if strings.EqualFold(k, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns the images that pass all the filters. The others get the filtered reason set, and they are counted
+in the returned map (reason -> count).
+ */
+func filterImages(images []*imagePlacemark) (passed []*imagePlacemark, filtered map[string]int) {
+	passed = make([]*imagePlacemark, 0, len(images))
+	filtered = map[string]int{}
+	for _, img := range images {
+		img.filtered = filterReason(img)
+		if img.filtered == "" {
+			passed = append(passed, img)
+		} else {
+			filtered[img.filtered]++
+		}
+	}
+	return passed, filtered
+}
+
+/*
+Returns a summary of the filtered images, eg. "5 filtered out (date: 3, location: 2)".
+ */
+func filteredSummary(filtered map[string]int) string {
+	total := 0
+	var reasons []string
+	for reason, n := range filtered {
+		total += n
+		reasons = append(reasons, fmt.Sprintf("%s: %d", reason, n))
+	}
+	if total == 0 {
+		return "0 filtered out"
+	}
+	sort.Strings(reasons)
+	return fmt.Sprintf("%d filtered out (%s)", total, strings.Join(reasons, ", "))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const earthRadius = 6371008.8 // mean radius in meters
+
+/*
+A point as [longitude, latitude] (the GeoJSON order).
+ */
+type lonLat [2]float64
+
+/*
+Returns the great-circle distance between the points in meters (haversine formula).
+ */
+func distance(a, b lonLat) float64 {
+	lat1, lat2 := a[1]*math.Pi/180, b[1]*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b[0] - a[0]) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+/*
+Returns the point at the fraction f (0-1) of the great-circle arc from a to b.
+ */
+func greatCirclePoint(a, b lonLat, f float64) lonLat {
+	toVector := func(p lonLat) [3]float64 {
+		lon, lat := p[0]*math.Pi/180, p[1]*math.Pi/180
+		return [3]float64{math.Cos(lat) * math.Cos(lon), math.Cos(lat) * math.Sin(lon), math.Sin(lat)}
+	}
+	d := distance(a, b) / earthRadius // angle
+	if d == 0 {
+		return a
+	}
+	va, vb := toVector(a), toVector(b)
+	wa, wb := math.Sin((1-f)*d)/math.Sin(d), math.Sin(f*d)/math.Sin(d)
+	var v [3]float64
+	for i := range v {
+		v[i] = wa*va[i] + wb*vb[i]
+	}
+	return lonLat{math.Atan2(v[1], v[0]) * 180 / math.Pi, math.Atan2(v[2], math.Hypot(v[0], v[1])) * 180 / math.Pi}
+}
+
+/*
+Returns true if the line segments ab and cd intersect (in plain lon/lat coordinates).
+ */
+func segmentsIntersect(a, b, c, d lonLat) bool {
+	orientation := func(p, q, r lonLat) float64 {
+		return (q[0]-p[0])*(r[1]-p[1]) - (q[1]-p[1])*(r[0]-p[0])
+	}
+	onSegment := func(p, q, r lonLat) bool { // r is collinear with pq
+		return math.Min(p[0], q[0]) <= r[0] && r[0] <= math.Max(p[0], q[0]) &&
+			math.Min(p[1], q[1]) <= r[1] && r[1] <= math.Max(p[1], q[1])
+	}
+	o1, o2 := orientation(a, b, c), orientation(a, b, d)
+	o3, o4 := orientation(c, d, a), orientation(c, d, b)
+	if (o1 > 0) != (o2 > 0) && (o3 > 0) != (o4 > 0) && o1 != 0 && o2 != 0 && o3 != 0 && o4 != 0 {
+		return true
+	}
+	return o1 == 0 && onSegment(a, b, c) || o2 == 0 && onSegment(a, b, d) ||
+		o3 == 0 && onSegment(c, d, a) || o4 == 0 && onSegment(c, d, b)
+}
+
+/*
+A polygon: the first ring is the outer boundary, the others are holes.
+ */
+type polygon [][]lonLat
+
+/*
+A bounding box. If minLon > maxLon, the box crosses the antimeridian.
+ */
+type bbox struct {
+	minLon, minLat, maxLon, maxLat float64
+}
+
+/*
+Parses a bounding box in the format "minLon,minLat,maxLon,maxLat".
+ */
+func parseBbox(s string) (b bbox, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return b, fmt.Errorf("bounding box has to be minLon,minLat,maxLon,maxLat: %q", s)
+	}
+	var vals [4]float64
+	for i, part := range parts {
+		vals[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return b, fmt.Errorf("invalid bounding box %q: %s", s, err)
+		}
+	}
+	b = bbox{minLon: vals[0], minLat: vals[1], maxLon: vals[2], maxLat: vals[3]}
+	if b.minLat > b.maxLat {
+		return b, fmt.Errorf("invalid bounding box %q: minLat is greater than maxLat", s)
+	}
+	return b, nil
+}
+
+/*
+Returns true if the point is inside the bounding box (or on its edge).
+ */
+func (b bbox) contains(p lonLat) bool {
+	if p[1] < b.minLat || p[1] > b.maxLat {
+		return false
+	}
+	if b.minLon <= b.maxLon {
+		return p[0] >= b.minLon && p[0] <= b.maxLon
+	}
+	return p[0] >= b.minLon || p[0] <= b.maxLon
+}
+
+/*
+Returns true if the point is inside the polygon (inside the outer ring and outside all the holes).
+ */
+func (poly polygon) contains(p lonLat) bool {
+	if len(poly) == 0 || !ringContains(poly[0], p) {
+		return false
+	}
+	for _, hole := range poly[1:] {
+		if ringContains(hole, p) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Returns the centroid of the outer ring of the polygon (the average of its vertices if its area is zero).
+ */
+func (poly polygon) centroid() lonLat {
+	if len(poly) == 0 || len(poly[0]) == 0 {
+		return lonLat{}
+	}
+	ring := poly[0]
+	var area, cx, cy, sumX, sumY float64
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		cross := ring[j][0]*ring[i][1] - ring[i][0]*ring[j][1]
+		area += cross
+		cx += (ring[j][0] + ring[i][0]) * cross
+		cy += (ring[j][1] + ring[i][1]) * cross
+		sumX += ring[i][0]
+		sumY += ring[i][1]
+	}
+	if area == 0 {
+		return lonLat{sumX / float64(len(ring)), sumY / float64(len(ring))}
+	}
+	return lonLat{cx / (3 * area), cy / (3 * area)}
+}
+
+/*
+Returns true if the point is inside the ring (ray casting).
+ */
+func ringContains(ring []lonLat, p lonLat) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > p[1]) != (b[1] > p[1]) && p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+/*
+Returns true if the point is inside any of the polygons.
+ */
+func anyPolygonContains(polygons []polygon, p lonLat) bool {
+	for _, poly := range polygons {
+		if poly.contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Loads all polygons from a GeoJSON file. Polygon and MultiPolygon geometries are supported,
+also inside Features, FeatureCollections and GeometryCollections.
+ */
+func loadGeoJsonPolygons(filepath string) ([]polygon, error) {
+	content, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	var obj geoJsonObject
+	if err := json.Unmarshal(content, &obj); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath, err)
+	}
+	polygons, err := obj.polygons()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath, err)
+	}
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("%s: no Polygon or MultiPolygon found", filepath)
+	}
+	return polygons, nil
+}
+
+/*
+Any GeoJSON object; only the fields needed for polygons and tracks are decoded.
+ */
+type geoJsonObject struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Properties  json.RawMessage `json:"properties"`
+	Geometry    *geoJsonObject  `json:"geometry"`
+	Geometries  []geoJsonObject `json:"geometries"`
+	Features    []geoJsonObject `json:"features"`
+}
+
+/*
+Returns the polygons in the object.
+ */
+func (o *geoJsonObject) polygons() ([]polygon, error) {
+	var polygons []polygon
+	switch o.Type {
+	case "Polygon":
+		var poly polygon
+		if err := json.Unmarshal(o.Coordinates, &poly); err != nil {
+			return nil, err
+		}
+		polygons = append(polygons, poly)
+	case "MultiPolygon":
+		var multi []polygon
+		if err := json.Unmarshal(o.Coordinates, &multi); err != nil {
+			return nil, err
+		}
+		polygons = append(polygons, multi...)
+	case "Feature":
+		if o.Geometry != nil {
+			return o.Geometry.polygons()
+		}
+	case "FeatureCollection", "GeometryCollection":
+		children := o.Features
+		if o.Type == "GeometryCollection" {
+			children = o.Geometries
+		}
+		for _, child := range children {
+			childPolygons, err := child.polygons()
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, childPolygons...)
+		}
+	}
+	return polygons, nil
+}
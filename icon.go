@@ -0,0 +1,426 @@
+package main
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	filepath2 "path/filepath"
+	"strings"
+)
+
+var iconBorderWidth = 3
+var iconShadowOffset = 2
+var iconShadowSigma = 1.5
+var iconBadgeColor = color.NRGBA{R: 0xe5, G: 0x39, B: 0x35, A: 0xff}
+
+var iconShapes = []string{"fit", "square", "circle", "rounded"}
+var iconBorderModes = []string{"none", "source", "folder", "day", "camera"}
+var iconOptionKeys = []string{"shape", "border", "shadow", "badge"} // keys of "icon" in the data file
+
+// colors of the borders by folder, day or camera (Tableau 10)
+var iconPalette = []color.RGBA{
+	{0x4e, 0x79, 0xa7, 0xff}, {0xf2, 0x8e, 0x2b, 0xff}, {0xe1, 0x57, 0x59, 0xff}, {0x76, 0xb7, 0xb2, 0xff},
+	{0x59, 0xa1, 0x4f, 0xff}, {0xed, 0xc9, 0x48, 0xff}, {0xb0, 0x7a, 0xa1, 0xff}, {0xff, 0x9d, 0xa7, 0xff},
+	{0x9c, 0x75, 0x5f, 0xff}, {0xba, 0xb0, 0xac, 0xff},
+}
+
+/*
+How the icon (thumbnail) of an image looks.
+ */
+type iconStyle struct {
+	shape  string // one of iconShapes
+	border string // one of iconBorderModes, or a color "rrggbb" or "rrggbbaa"
+	shadow bool
+	badge  string // "video", a short text (e.g. a count), or empty
+}
+
+/*
+Checks the icon flags. Returns an error if any of them is invalid.
+ */
+func setupIcons() error {
+	if !containsString(iconShapes, iconShape) {
+		return fmt.Errorf("-icon-shape has to be one of: %s", strings.Join(iconShapes, ", "))
+	}
+	if msg := checkIconBorder(iconBorder); msg != "" {
+		return fmt.Errorf("-icon-border: %s", msg)
+	}
+	return nil
+}
+
+/*
+Returns a description of the problem with the border (a mode or a color), or an empty string if it is fine.
+ */
+func checkIconBorder(border string) string {
+	if containsString(iconBorderModes, border) {
+		return ""
+	}
+	if _, err := parseHexColor(border); err != nil || len(border) != 6 && len(border) != 8 {
+		return fmt.Sprintf("%q is neither a color (rrggbb) nor one of: %s", border, strings.Join(iconBorderModes, ", "))
+	}
+	return ""
+}
+
+/*
+Returns a description of the problem with the "icon" object of a data file item, or an empty string if it is fine.
+ */
+func checkIconOptions(options dataObj) string {
+	for _, key := range sortedKeys(options) {
+		val := options[key]
+		switch key {
+		case "shape":
+			if s, ok := val.(string); !ok || !containsString(iconShapes, s) {
+				return fmt.Sprintf("shape has to be one of: %s", strings.Join(iconShapes, ", "))
+			}
+		case "border":
+			s, ok := val.(string)
+			if !ok {
+				return "border has to be a string"
+			}
+			if msg := checkIconBorder(s); msg != "" {
+				return "border " + msg
+			}
+		case "shadow":
+			if _, ok := val.(bool); !ok {
+				return "shadow has to be a boolean"
+			}
+		case "badge":
+			if s := fmt.Sprint(val); s != "video" && len(s) > 3 {
+				return "badge has to be \"video\" or a text of at most 3 characters"
+			}
+		default:
+			return fmt.Sprintf("unknown key %q (use %s)", key, strings.Join(iconOptionKeys, ", "))
+		}
+	}
+	return ""
+}
+
+/*
+Returns the icon style of the image: the flags overridden by the "icon" object from the data file.
+ */
+func (i *imagePlacemark) iconStyle() iconStyle {
+	style := iconStyle{shape: iconShape, border: iconBorder, shadow: iconShadow}
+	if s, ok := i.iconOptions["shape"].(string); ok {
+		style.shape = s
+	}
+	if s, ok := i.iconOptions["border"].(string); ok {
+		style.border = s
+	}
+	if b, ok := i.iconOptions["shadow"].(bool); ok {
+		style.shadow = b
+	}
+	if badge, ok := i.iconOptions["badge"]; ok {
+		style.badge = fmt.Sprint(badge)
+	}
+	return style
+}
+
+/*
+Returns the icon style of the image as the icon is drawn: with the count badge of the collapsed duplicates
+(see setCountBadge), which is not a part of iconStyle, as it is known only after the duplicates are found.
+ */
+func (i *imagePlacemark) drawnIconStyle() iconStyle {
+	style := i.iconStyle()
+	if style.badge == "" {
+		style.badge = i.countBadge
+	}
+	return style
+}
+
+/*
+Returns the border color of the image's icon according to the border mode (or color), or nil if it has no border.
+ */
+func (i *imagePlacemark) iconBorderColor(border string) *color.RGBA {
+	key := ""
+	switch border {
+	case "none":
+		return nil
+	case "source":
+		if i.source == nil {
+			return nil
+		}
+		return i.source.color
+	case "folder":
+		key = filepath2.Dir(i.path)
+	case "day":
+		if !i.hasDateTime {
+			return nil
+		}
+		key = i.dateTime.Format("2006-01-02")
+	case "camera":
+		key = i.cameraName()
+		if key == "" {
+			return nil
+		}
+	default:
+		c, err := parseHexColor(border)
+		if err != nil {
+			return nil
+		}
+		return &c
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	c := iconPalette[h.Sum32()%uint32(len(iconPalette))]
+	return &c
+}
+
+/*
+Returns the camera make and model from the EXIF, or an empty string.
+ */
+func (i *imagePlacemark) cameraName() string {
+	if i.origExif == nil {
+		return ""
+	}
+	var parts []string
+	for _, field := range []exif.FieldName{exif.Make, exif.Model} {
+		if tag, err := i.origExif.Get(field); err == nil {
+			if s, err := tag.StringVal(); err == nil && strings.TrimSpace(s) != "" {
+				parts = append(parts, strings.Trim(s, "\x00 "))
+			}
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+/*
+Creates the icon of the image in the given style: resizes (and crops) it, applies the mask and the border,
+and adds the shadow and the badge.
+ */
+func createIcon(img image.Image, style iconStyle, borderColor *color.RGBA) image.Image {
+	var icon image.Image
+	if style.shape == "fit" {
+		icon = resizeImage(img, iconMaxSize)
+	} else {
+		icon = resizeImage(smartCropSquare(img), iconMaxSize)
+	}
+
+	borderWidth := 0
+	if borderColor != nil {
+		borderWidth = iconBorderWidth
+	}
+	if style.shape == "circle" || style.shape == "rounded" || borderColor != nil {
+		icon = maskIcon(icon, style.shape, borderColor, borderWidth)
+	}
+	if style.shadow {
+		icon = addShadow(icon)
+	}
+	if style.badge != "" {
+		icon = addBadge(icon, style.badge)
+	}
+	return icon
+}
+
+/*
+Returns the square part of the image with the most details (edges). The square spans the shorter side,
+only its position along the longer side is chosen.
+ */
+func smartCropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == h {
+		return img
+	}
+
+	// the energy is computed on a small grayscale copy
+	small := imaging.Grayscale(imaging.Fit(img, 128, 128, imaging.Box))
+	sw, sh := small.Bounds().Dx(), small.Bounds().Dy()
+	gray := func(x, y int) float64 {
+		return float64(small.Pix[y*small.Stride+x*4])
+	}
+	horizontal := w > h
+	length, across := sh, sw
+	if horizontal {
+		length, across = sw, sh
+	}
+	energy := make([]float64, length) // energy of each column (or row)
+	for x := 0; x+1 < sw; x++ {
+		for y := 0; y+1 < sh; y++ {
+			e := math.Abs(gray(x+1, y)-gray(x, y)) + math.Abs(gray(x, y+1)-gray(x, y))
+			if horizontal {
+				energy[x] += e
+			} else {
+				energy[y] += e
+			}
+		}
+	}
+
+	// slide the window over the longer side
+	window := across
+	best, bestSum, sum := 0, -1.0, 0.0
+	for n := 0; n < length; n++ {
+		sum += energy[n]
+		if n >= window {
+			sum -= energy[n-window]
+		}
+		if n >= window-1 && sum > bestSum {
+			best, bestSum = n-window+1, sum
+		}
+	}
+
+	side := w
+	if horizontal {
+		side = h
+	}
+	offset := int(math.Round(float64(best) * float64(maxInt(w, h)) / float64(length)))
+	if offset+side > maxInt(w, h) {
+		offset = maxInt(w, h) - side
+	}
+	if horizontal {
+		return imaging.Crop(img, image.Rect(b.Min.X+offset, b.Min.Y, b.Min.X+offset+side, b.Max.Y))
+	}
+	return imaging.Crop(img, image.Rect(b.Min.X, b.Min.Y+offset, b.Max.X, b.Min.Y+offset+side))
+}
+
+/*
+Returns the icon cut to the shape (rectangle for fit and square, circle or rounded rectangle) with a transparent
+background, surrounded by a border of the color and width (if the color is not nil).
+ */
+func maskIcon(icon image.Image, shape string, borderColor *color.RGBA, borderWidth int) *image.NRGBA {
+	src := imaging.Clone(icon)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	out := image.NewNRGBA(image.Rect(0, 0, w+2*borderWidth, h+2*borderWidth))
+
+	// signed distance from the edge of the shape (negative inside), the center is in [0, 0]
+	radius := 0.0
+	switch shape {
+	case "circle":
+		radius = math.Min(float64(w), float64(h)) / 2
+	case "rounded":
+		radius = math.Min(float64(w), float64(h)) / 5
+	}
+	distance := func(x, y, halfW, halfH float64) float64 {
+		dx := math.Abs(x) - (halfW - radius)
+		dy := math.Abs(y) - (halfH - radius)
+		outside := math.Hypot(math.Max(dx, 0), math.Max(dy, 0))
+		return outside + math.Min(math.Max(dx, dy), 0) - radius
+	}
+	coverage := func(d float64) float64 { // simple antialiasing
+		return math.Max(0, math.Min(1, 0.5-d))
+	}
+
+	cx, cy := float64(out.Bounds().Dx())/2, float64(out.Bounds().Dy())/2
+	for y := 0; y < out.Bounds().Dy(); y++ {
+		for x := 0; x < out.Bounds().Dx(); x++ {
+			px, py := float64(x)+0.5-cx, float64(y)+0.5-cy
+			d := distance(px, py, float64(w)/2, float64(h)/2)
+			inner := coverage(d)
+			outer := coverage(d - float64(borderWidth))
+			if outer == 0 {
+				continue
+			}
+
+			var c color.NRGBA
+			if ix, iy := x-borderWidth, y-borderWidth; ix >= 0 && iy >= 0 && ix < w && iy < h {
+				c = src.NRGBAAt(ix, iy)
+			}
+			if borderColor != nil {
+				c = mixColors(color.NRGBA{R: borderColor.R, G: borderColor.G, B: borderColor.B, A: borderColor.A}, c, inner)
+			}
+			c.A = uint8(float64(c.A)*outer + 0.5)
+			out.SetNRGBA(x, y, c)
+		}
+	}
+	return out
+}
+
+/*
+Returns the mix of the colors: a*(1-t) + b*t.
+ */
+func mixColors(a, b color.NRGBA, t float64) color.NRGBA {
+	mix := func(x, y uint8) uint8 {
+		return uint8(float64(x)*(1-t) + float64(y)*t + 0.5)
+	}
+	return color.NRGBA{R: mix(a.R, b.R), G: mix(a.G, b.G), B: mix(a.B, b.B), A: mix(a.A, b.A)}
+}
+
+/*
+Returns the icon with a soft drop shadow below it (to the bottom right).
+ */
+func addShadow(icon image.Image) *image.NRGBA {
+	b := icon.Bounds()
+	pad := iconShadowOffset + int(math.Ceil(iconShadowSigma*2))
+	shadow := image.NewNRGBA(image.Rect(0, 0, b.Dx()+pad, b.Dy()+pad))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			_, _, _, a := icon.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			shadow.SetNRGBA(x+iconShadowOffset, y+iconShadowOffset, color.NRGBA{A: uint8(a >> 9)}) // half opacity
+		}
+	}
+	shadow = imaging.Blur(shadow, iconShadowSigma)
+	return imaging.Overlay(shadow, icon, image.Pt(0, 0), 1)
+}
+
+/*
+Returns the icon with a badge in the top right corner: a play symbol for "video", otherwise the text.
+ */
+func addBadge(icon image.Image, badge string) *image.NRGBA {
+	out := imaging.Clone(icon)
+	b := out.Bounds()
+	size := maxInt(14, minInt(b.Dx(), b.Dy())*2/5)
+	if badge != "video" {
+		size = maxInt(size, len(badge)*7+6) // 7 px per character of the font
+	}
+	cx, cy, r := float64(b.Max.X)-float64(size)/2, float64(size)/2, float64(size)/2
+
+	for y := 0; y < size; y++ {
+		for x := b.Max.X - size; x < b.Max.X; x++ {
+			d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) - r
+			if alpha := math.Max(0, math.Min(1, 0.5-d)); alpha > 0 {
+				white := math.Max(0, math.Min(1, d+1.5)) // white outline
+				c := mixColors(iconBadgeColor, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, white)
+				out.SetNRGBA(x, y, mixColors(out.NRGBAAt(x, y), c, alpha))
+			}
+		}
+	}
+
+	if badge == "video" { // play triangle
+		for y := 0; y < size; y++ {
+			for x := b.Max.X - size; x < b.Max.X; x++ {
+				px, py := (float64(x)+0.5-cx)/r, (float64(y)+0.5-cy)/r
+				if px > -0.3 && px < 0.45 && math.Abs(py) < (0.45-px)*0.6 {
+					out.SetNRGBA(x, y, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+				}
+			}
+		}
+		return out
+	}
+
+	face := basicfont.Face7x13
+	drawer := font.Drawer{Dst: out, Src: image.White, Face: face}
+	width := drawer.MeasureString(badge).Round()
+	drawer.Dot = fixed.P(int(cx)-width/2, int(cy)+face.Ascent/2-1)
+	drawer.DrawString(badge)
+	return out
+}
+
+/*
+Returns the image on a white background (for formats without transparency).
+ */
+func flattenImage(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	out := imaging.New(b.Dx(), b.Dy(), color.White)
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Over)
+	return out
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -3,17 +3,20 @@ package main
 import (
 	"fmt"
 	"github.com/rwcarlsen/goexif/exif"
-	"log"
 	"math"
 	"os"
 	"strings"
 	"time"
 )
 
+const exifTimeLayout = "2006:01:02 15:04:05"
+
 type imagePlacemark struct {
 	path       string // location of the file relative to the root dir (should be normalized) (empty if pure external image)
+	origPath   string // the original path (path changes when the image is resized)
 	iconPath   string // location of the thumbnail (or the actual image) relative to the root dir (empty if pure external image)
 	rootDir    string // actual location of the root dir (should be normalized) (empty if pure external image)
+	source     *imageSource // input source of the image (nil if pure external image)
 
 	isInternal     bool
 	isIconInternal bool
@@ -26,20 +29,56 @@ type imagePlacemark struct {
 
 	origExif   *exif.Exif
 	customData dataObj
+	properties dataObj // custom properties from the data file, written to KML as ExtendedData
+	iconOptions dataObj // icon style from the data file (see iconStyle)
+	dataRules  []string // data file rules (defaults and items) applied to the image, in order
 
+	id 			 string // id of the placemark in the KML document (see assignImageIds)
 	name 		 string
 	description  string
 	dateTime	 time.Time
 	latitude	 float64
 	longitude	 float64
+	altitude     float64 // meters above sea level
 
 	hasLocation  bool
+	hasAltitude  bool
 	hasDateTime  bool
 
+	rating    int
+	hasRating bool
+	keywords  []string
+	filtered  string // reason why the image is filtered out (empty if it is not)
+
+	privacyZone *privacyZone // the privacy zone the image is in (nil if it is in none)
+
+	warnings []string // warnings about the image (for the report)
+	errors   []string // errors of the image (for the report)
+
+	fingerprint *imageFingerprint // for finding duplicates (nil if they are not searched for)
+	duplicates  []*imagePlacemark // duplicates collapsed into this image's placemark
+	countBadge  string            // count of the collapsed duplicates in the icon badge (empty if there is none)
+
+	upToDate bool // the files in the output directory are up to date (-update), the image is not resized again
+
 	width  int64
 	length int64
 }
 
+/*
+Returns the name of the image used in messages: the original path (with the source label, if there are more
+sources), or the external path.
+ */
+func (i *imagePlacemark) displayName() string {
+	if i.source == nil {
+		return i.externalPath
+	}
+	if len(sources) > 1 {
+		return i.origPath + " (" + i.source.label + ")"
+	}
+	return i.origPath
+}
+
 /*
 Decodes and returns the EXIF of the file.
 */
@@ -77,6 +116,19 @@ func (i *imagePlacemark) applyDataFromExif() {
 		i.hasLocation = true
 	}
 
+	// altitude
+	if alt, err := i.origExif.Get(exif.GPSAltitude); err == nil {
+		if num, den, err := alt.Rat2(0); err == nil && den != 0 {
+			i.altitude = float64(num) / float64(den)
+			i.hasAltitude = true
+			if ref, err := i.origExif.Get(exif.GPSAltitudeRef); err == nil {
+				if r, err := ref.Int(0); err == nil && r == 1 { // below sea level
+					i.altitude = -i.altitude
+				}
+			}
+		}
+	}
+
 	// width & height
 	if w, err := i.origExif.Get(exif.ImageWidth); err == nil {
 		i.width, _ = w.Int64(0)
@@ -93,9 +145,20 @@ func (i *imagePlacemark) setCustomData(data dataObj) {
 	i.customData = data
 }
 
+/*
+Records the data file rules applied to the image.
+ */
+func (i *imagePlacemark) setDataRules(rules []*dataRule) {
+	i.dataRules = make([]string, len(rules))
+	for n, rule := range rules {
+		i.dataRules[n] = rule.String()
+	}
+}
+
 /*
 Sets image properties according to the customData object for the image
-Used JSON/YAML fields/keys: "external" string, "dateTime" string, "timeZone" string, "latitude" float64, "longitude" float64
+Used JSON/YAML fields/keys: "external" string, "dateTime" string, "timeZone" string, "latitude" float64, "longitude" float64,
+"altitude" float64, "properties" object, "icon" object
  */
 func (i *imagePlacemark) applyCustomData() {
 	if i.customData == nil {
@@ -111,19 +174,19 @@ func (i *imagePlacemark) applyCustomData() {
 
 	// dateTime (+ timeZone)
 	if dt, ok := i.customData["dateTime"]; ok {
-		exifTimeLayout := "2006:01:02 15:04:05"
 		dateStr := strings.Trim(dt.(string), "\x00 ")
 		location := time.Local
 		if tz, ok := i.customData["timeZone"]; ok {
 			if loc, err := time.LoadLocation(tz.(string)); err == nil {
 				location = loc
 			} else {
-				log.Println(err)
+				i.warn(err.Error())
 			}
 		}
 		i.dateTime, err = time.ParseInLocation(exifTimeLayout, dateStr, location)
-		printIfErr(err)
-		if err == nil {
+		if err != nil {
+			i.warn(err.Error())
+		} else {
 			i.hasDateTime = true
 		}
 	}
@@ -140,11 +203,29 @@ func (i *imagePlacemark) applyCustomData() {
 				// add the difference to the dateTime to fix the time zone (change the timestamp)
 				i.dateTime = i.dateTime.Add(timeZonesDiff)
 			} else {
-				log.Println(err)
+				i.warn(err.Error())
 			}
 		}
 	}
 
+	// custom properties
+	if props, ok := i.customData["properties"].(dataObj); ok {
+		i.properties = props
+	}
+
+	// altitude
+	if alt, ok := i.customData["altitude"]; ok {
+		if float, err := getFloat64(alt); err == nil {
+			i.altitude = float
+			i.hasAltitude = true
+		}
+	}
+
+	// icon style
+	if options, ok := i.customData["icon"].(dataObj); ok {
+		i.iconOptions = options
+	}
+
 	// latitude & longitude
 	if lat, ok := i.customData["latitude"]; ok {
 		float, err := getFloat64(lat)
@@ -175,7 +256,7 @@ func (i *imagePlacemark) setKmlPaths(preferExternal, preferExternalIcon bool) {
 	if preferExternal && i.externalPath != "" || i.path == "" {
 		i.pathInKml = i.externalPath
 	} else {
-		i.pathInKml = joinPaths("files", i.path)
+		i.pathInKml = joinPaths("files", i.source.filesDir, resizedImagePath(i.path))
 		i.isInternal = true
 	}
 
@@ -183,7 +264,7 @@ func (i *imagePlacemark) setKmlPaths(preferExternal, preferExternalIcon bool) {
 	if preferExternalIcon && i.iconExternalPath != "" || i.iconPath == "" {
 		i.iconPathInKml = i.iconExternalPath
 	} else {
-		i.iconPathInKml = joinPaths("files", i.iconPath)
+		i.iconPathInKml = joinPaths("files", i.source.filesDir, i.iconPath)
 		i.isIconInternal = true
 	}
 }
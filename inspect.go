@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Prints the resolved information about each image: its time, location, the data file rules that matched it
+and whether it is filtered out.
+ */
+func printInspection(images []*imagePlacemark) {
+	for _, img := range images {
+		if img.source != nil && len(sources) > 1 {
+			fmt.Printf("%s (%s)\n", img.path, img.source.label)
+		} else if img.source != nil {
+			fmt.Println(img.path)
+		} else {
+			fmt.Println(img.externalPath)
+		}
+
+		if img.hasDateTime {
+			fmt.Println("  dateTime:", img.dateTime)
+		} else {
+			fmt.Println("  dateTime: none")
+		}
+
+		if img.hasLocation {
+			fmt.Printf("  location: %f, %f\n", img.latitude, img.longitude)
+		} else {
+			fmt.Println("  location: none")
+		}
+
+		if img.hasRating {
+			fmt.Println("  rating:  ", img.rating)
+		}
+		if len(img.keywords) > 0 {
+			fmt.Println("  keywords:", strings.Join(img.keywords, ", "))
+		}
+
+		if img.privacyZone != nil {
+			fmt.Printf("  privacy: %s (%s)\n", img.privacyZone.name, img.privacyZone.action)
+		}
+		if img.filtered != "" {
+			fmt.Println("  filtered: by", img.filtered)
+		}
+
+		if len(img.dataRules) > 0 {
+			fmt.Println("  rules:   ", strings.Join(img.dataRules, "; "))
+		} else {
+			fmt.Println("  rules:    none")
+		}
+	}
+
+	filtered := 0
+	for _, img := range images {
+		if img.filtered != "" {
+			filtered++
+		}
+	}
+	fmt.Printf("%d image(s), %d filtered out\n", len(images), filtered)
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/xml"
+	"fmt"
 	"github.com/twpayne/go-kml"
 	"image/color"
+	filepath2 "path/filepath"
+	"sort"
+	"strings"
 )
 
 var iconScale = 2.0
@@ -33,7 +38,7 @@ Add a image placemark into the given element (usually Document or Folder).
 The description image placemark has a HTML img tag in the description.
 */
 func addDescriptionImagePlacemark(el *kml.CompoundElement, img *imagePlacemark) {
-	el.Add(
+	el.Add(withImageData(img,
 		kml.Placemark(
 			kml.Name(img.name),
 			kml.Description(`
@@ -41,7 +46,7 @@ func addDescriptionImagePlacemark(el *kml.CompoundElement, img *imagePlacemark)
 <html>
 <head></head>
 <body>
-	<img src="`+img.pathInKml+`" style="display: block; max-width: 800px; max-height: 800px; width: auto; height: auto;" />
+	`+imgTags(img, ` style="display: block; max-width: 800px; max-height: 800px; width: auto; height: auto;" `)+`
 	<p>`+img.description+`</p>
 </body>
 </html>
@@ -58,7 +63,7 @@ func addDescriptionImagePlacemark(el *kml.CompoundElement, img *imagePlacemark)
 				),
 			),
 		),
-	)
+	))
 }
 
 /*
@@ -66,7 +71,7 @@ Add a image placemark into the given element (usually Document or Folder).
 The HTML image placemark has a HTML balloon style with a img tag.
  */
 func addHtmlImagePlacemark(el *kml.CompoundElement, img *imagePlacemark) {
-	el.Add(
+	el.Add(withImageData(img,
 		kml.Placemark(
 			kml.Name(img.name),
 			kml.Description(img.description),
@@ -91,7 +96,7 @@ func addHtmlImagePlacemark(el *kml.CompoundElement, img *imagePlacemark) {
 </head>
 <body>
 	<!--<p>$[name]</p>-->
-	<img src="`+img.pathInKml+`"/>
+	`+imgTags(img, "")+`
 	<p>$[description]</p>
 </body>
 </html>
@@ -99,14 +104,14 @@ func addHtmlImagePlacemark(el *kml.CompoundElement, img *imagePlacemark) {
 				),
 			),
 		),
-	)
+	))
 }
 
 /*
 Almost same as addHtmlImagePlacemark, but added gx:displayMode panel (so it will be displayed as a panel - in GEW).
  */
 func addGxPanelHtmlImage(el *kml.CompoundElement, img *imagePlacemark) {
-	el.Add(
+	el.Add(withImageData(img,
 		kml.Placemark(
 			kml.Name(img.name),
 			kml.Description(img.description),
@@ -131,7 +136,7 @@ func addGxPanelHtmlImage(el *kml.CompoundElement, img *imagePlacemark) {
 </head>
 <body>
 	<!--<p>$[name]</p>-->
-	<img src="`+img.pathInKml+`"/>
+	`+imgTags(img, "")+`
 	<p>$[description]</p>
 </body>
 </html>
@@ -140,7 +145,7 @@ func addGxPanelHtmlImage(el *kml.CompoundElement, img *imagePlacemark) {
 				),
 			),
 		),
-	)
+	))
 }
 
 /*
@@ -153,12 +158,11 @@ func addPhotoOverlayPlacemark(el *kml.CompoundElement, img *imagePlacemark) {
 		w = 1
 		l = 1
 	}
-	id := img.name 	// todo better id
 	coordinate := kml.Coordinate{Lat: img.latitude, Lon: img.longitude}
 	photoOverlay := kml.PhotoOverlay(
 		kml.Name(img.name),
 		kml.Description(`<!DOCTYPE html><html><head></head><body>
-<a href="#`+id+`">Click here to fly into photo</a><br>
+<a href="#`+img.id+`">Click here to fly into photo</a><br>
 </body></html>`),
 		kml.Open(false),
 		kml.Visibility(true),
@@ -198,14 +202,7 @@ func addPhotoOverlayPlacemark(el *kml.CompoundElement, img *imagePlacemark) {
 			),
 		),
 	)
-	photoOverlay.Attr = append(photoOverlay.Attr, xml.Attr{
-		Name:  xml.Name{
-			Space: "",
-			Local: "id",
-		},
-		Value: id,
-	})
-	el.Add(photoOverlay)
+	el.Add(withImageData(img, photoOverlay))
 }
 
 /*
@@ -214,7 +211,7 @@ This placemark uses gx:Carousel.
 fixme
  */
 func addGxCarouselPlacemark(el *kml.CompoundElement, img *imagePlacemark) {
-	el.Add(
+	el.Add(withImageData(img,
 		kml.Placemark(
 			kml.Name(img.name),
 			kml.Description(`<!DOCTYPE html><html><head></head><body>
@@ -231,13 +228,142 @@ func addGxCarouselPlacemark(el *kml.CompoundElement, img *imagePlacemark) {
 					),
 				),
 			),
-			newCompoundEl("gx:Carousel").Add(
-				newCompoundEl("gx:Image").Add(
-					newSimpleEl("gx:ImageUrl", img.pathInKml),
-				),
-			),
+			gxCarousel(img),
 		),
-	)
+	))
+}
+
+/*
+Returns a gx:Carousel with the image and its collapsed duplicates.
+ */
+func gxCarousel(img *imagePlacemark) *kml.CompoundElement {
+	carousel := newCompoundEl("gx:Carousel")
+	for _, i := range append([]*imagePlacemark{img}, img.duplicates...) {
+		carousel.Add(newCompoundEl("gx:Image").Add(
+			newSimpleEl("gx:ImageUrl", i.pathInKml),
+		))
+	}
+	return carousel
+}
+
+/*
+Returns HTML img tags (with the attributes) of the image and its collapsed duplicates.
+ */
+func imgTags(img *imagePlacemark, attrs string) string {
+	tags := `<img src="` + img.pathInKml + `"` + attrs + `/>`
+	for _, dup := range img.duplicates {
+		tags += "\n\t" + `<img src="` + dup.pathInKml + `"` + attrs + `/>`
+	}
+	return tags
+}
+
+/*
+Sets the ids of the placemarks of the images. The id is made only from the identity of the source image: the label
+of its source and its path in the source directory (or the URL of a pure external image), so the placemark of
+the same image has the same id in every build, even if the file has changed (e.g. a rating was added), which -append
+uses to replace it. Images with the same id get a number, in the order of their sources (-i), paths and other
+properties, so the numbers do not depend on the order of the images.
+ */
+func assignImageIds(images []*imagePlacemark) {
+	groups := map[string][]*imagePlacemark{}
+	for _, img := range images {
+		key := img.externalPath
+		if img.source != nil {
+			key = img.source.label + "\n" + filepath2.ToSlash(img.origPath)
+		}
+		h := sha256.Sum256([]byte(key))
+		base := fmt.Sprintf("photo-%x", h[:8])
+		groups[base] = append(groups[base], img)
+	}
+	for base, group := range groups {
+		if len(group) == 1 {
+			group[0].id = base
+			continue
+		}
+		sort.SliceStable(group, func(i, j int) bool {
+			return compareImageIdentity(group[i], group[j]) < 0
+		})
+		for n, img := range group {
+			img.id = base
+			if n > 0 {
+				img.id = fmt.Sprintf("%s-%d", base, n+1)
+			}
+		}
+	}
+}
+
+/*
+Compares the images with the same id by the index of their source, their original path, external path, time
+and location. Returns a negative number if a goes first, a positive number if b goes first.
+ */
+func compareImageIdentity(a, b *imagePlacemark) int {
+	if ia, ib := sourceIndex(a.source), sourceIndex(b.source); ia != ib {
+		return ia - ib
+	}
+	if c := strings.Compare(a.origPath, b.origPath); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.externalPath, b.externalPath); c != 0 {
+		return c
+	}
+	if !a.dateTime.Equal(b.dateTime) {
+		if a.dateTime.Before(b.dateTime) {
+			return -1
+		}
+		return 1
+	}
+	for _, d := range []float64{a.latitude - b.latitude, a.longitude - b.longitude} {
+		if d < 0 {
+			return -1
+		} else if d > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+/*
+Returns the index of the source in the sources (-i order), -1 for nil (a pure external image).
+ */
+func sourceIndex(src *imageSource) int {
+	for i, s := range sources {
+		if s == src {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+Adds the id of the image and ExtendedData with its custom properties to the element (placemark) and returns
+the element. ExtendedData is left out if the image has no properties.
+ */
+func withImageData(img *imagePlacemark, el *kml.CompoundElement) *kml.CompoundElement {
+	if img.id != "" {
+		el.Attr = append(el.Attr, xml.Attr{Name: xml.Name{Local: "id"}, Value: img.id})
+	}
+	if len(img.properties) == 0 {
+		return el
+	}
+
+	extData := kml.ExtendedData()
+	for _, key := range sortedKeys(img.properties) {
+		extData.Add(newData(key, "", fmt.Sprint(img.properties[key])))
+	}
+	return el.Add(extData)
+}
+
+/*
+Returns a Data element of ExtendedData. The displayName is left out if it is empty.
+ */
+func newData(name, displayName, value string) *kml.CompoundElement {
+	data := kml.Data()
+	if displayName != "" {
+		data.Add(kml.DisplayName(displayName))
+	}
+	data.Add(kml.Value(value))
+	data.Attr = append(data.Attr, xml.Attr{Name: xml.Name{Local: "name"}, Value: name})
+	return data
 }
 
 /*
@@ -266,23 +392,54 @@ func newSimpleEl(name, value string) *kml.SimpleElement {
 }
 
 /*
-Creates a line connecting the given coordinates.
+Creates a line placemark of the given geometries (LineStrings or gx:Tracks). More geometries are put
+into a MultiGeometry. The extra elements (e.g. description) are added after the name.
+Nothing is created if there is no geometry.
  */
-func createLine(el *kml.CompoundElement, coordinates []kml.Coordinate) {
-	el.Add(
-		kml.Placemark(
-			kml.Name(pathName),
-			kml.Style(
-				kml.LineStyle(
-					kml.Color(pathLineColor),
-					kml.Width(pathLineWidth),
-				),
-			),
-			kml.LineString(
-				kml.Extrude(true),
-				kml.Tessellate(true),
-				kml.Coordinates(coordinates...),
+func createLine(el *kml.CompoundElement, name string, lineColor color.RGBA, width float64, lines []kml.Element, extra ...kml.Element) {
+	if len(lines) == 0 {
+		return
+	}
+	geometry := lines[0]
+	if len(lines) > 1 {
+		geometry = kml.MultiGeometry(lines...)
+	}
+
+	placemark := kml.Placemark(kml.Name(name))
+	placemark.Add(extra...)
+	placemark.Add(
+		kml.Style(
+			kml.LineStyle(
+				kml.Color(lineColor),
+				kml.Width(width),
 			),
 		),
+		geometry,
 	)
-}
\ No newline at end of file
+	el.Add(placemark)
+}
+
+/*
+Returns a LineString connecting the coordinates.
+ */
+func lineString(coordinates []kml.Coordinate) kml.Element {
+	return kml.LineString(
+		kml.Extrude(true),
+		kml.Tessellate(true),
+		kml.Coordinates(coordinates...),
+	)
+}
+
+/*
+Returns a gx:Track of the points, which all have to have time. The track can be animated by the time slider.
+ */
+func gxTrack(points []pathPoint) kml.Element {
+	track := kml.GxTrack(kml.AltitudeMode(kml.AltitudeModeClampToGround))
+	for _, p := range points {
+		track.Add(kml.When(p.time))
+	}
+	for _, p := range points {
+		track.Add(kml.GxCoord(kml.Coordinate{Lon: p.lonLat[0], Lat: p.lonLat[1]}))
+	}
+	return track
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAssignImageIdsIsStable(t *testing.T) {
+	src := &imageSource{dir: t.TempDir(), label: "italy"}
+	sources = []*imageSource{src}
+	defer func() { sources = nil }()
+
+	a := &imagePlacemark{source: src, origPath: "day1/a.jpg"}
+	assignImageIds([]*imagePlacemark{a})
+	first := a.id
+	// the content of the file is not a part of the id
+	a.id, a.rating, a.hasRating = "", 5, true
+	assignImageIds([]*imagePlacemark{a})
+	if a.id != first {
+		t.Errorf("the id has changed: %s, %s", first, a.id)
+	}
+
+	other := &imagePlacemark{source: &imageSource{label: "croatia"}, origPath: "day1/a.jpg"}
+	assignImageIds([]*imagePlacemark{other})
+	if other.id == first {
+		t.Error("images of different sources have the same id")
+	}
+}
+
+func TestAssignImageIdsCollisionsAreDeterministic(t *testing.T) {
+	newImages := func() (early, late *imagePlacemark) {
+		early = &imagePlacemark{externalPath: "https://example.com/a.jpg", dateTime: time.Unix(100, 0)}
+		late = &imagePlacemark{externalPath: "https://example.com/a.jpg", dateTime: time.Unix(200, 0)}
+		return
+	}
+	early1, late1 := newImages()
+	assignImageIds([]*imagePlacemark{early1, late1})
+	early2, late2 := newImages()
+	assignImageIds([]*imagePlacemark{late2, early2})
+	if early1.id == late1.id {
+		t.Fatalf("the images have the same id %s", early1.id)
+	}
+	if early1.id != early2.id || late1.id != late2.id {
+		t.Errorf("the ids depend on the order: %s %s, %s %s", early1.id, late1.id, early2.id, late2.id)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+var logFormats = []string{"text", "json"}
+
+// exit codes
+const (
+	exitOK      = 0
+	exitFailure = 1 // other errors
+	exitUsage   = 2 // invalid command, flags or configuration file (the same code as of the flag package)
+	exitInput   = 3 // the input (images, data file, tracks...) cannot be read
+	exitOutput  = 4 // the output cannot be written
+)
+
+var failureCode int // exit code of the first error that did not stop the build (used by -strict)
+var failures int    // number of such errors
+
+var cleanups []func() // run before exiting (see exit)
+
+/*
+Sets up the default logger according to -log-format, -quiet and -verbose.
+ */
+func setupLogging() error {
+	if !containsString(logFormats, logFormat) {
+		return fmt.Errorf("-log-format has to be one of: %s", strings.Join(logFormats, ", "))
+	}
+	if quiet && verbose {
+		return fmt.Errorf("-quiet and -verbose cannot be used together")
+	}
+	level := slog.LevelInfo
+	if quiet {
+		level = slog.LevelError
+	} else if verbose {
+		level = slog.LevelDebug
+	}
+
+	if logFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	} else {
+		slog.SetDefault(slog.New(&textHandler{out: os.Stderr, level: level, mu: &sync.Mutex{}}))
+	}
+	return nil
+}
+
+/*
+A slog handler writing human-readable lines: "warning: a.jpg: has no location key=value".
+Info messages have no level prefix, the "image" attribute is written before the message.
+ */
+type textHandler struct {
+	out   io.Writer
+	level slog.Level
+	attrs []slog.Attr
+	mu    *sync.Mutex
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var prefix, suffix string
+	add := func(a slog.Attr) bool {
+		if a.Key == "image" {
+			prefix += a.Value.String() + ": "
+		} else {
+			suffix += fmt.Sprintf(" %s=%q", a.Key, a.Value.String())
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(add)
+
+	switch {
+	case r.Level >= slog.LevelError:
+		prefix = "error: " + prefix
+	case r.Level >= slog.LevelWarn:
+		prefix = "warning: " + prefix
+	case r.Level < slog.LevelInfo:
+		prefix = "debug: " + prefix
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defer clearProgressBar()() // the line is written above the bar
+	_, err := fmt.Fprintln(h.out, prefix+r.Message+suffix)
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &h2
+}
+
+func (h *textHandler) WithGroup(_ string) slog.Handler {
+	return h // groups are not used
+}
+
+/*
+An error with the exit code it should cause.
+ */
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+/*
+Marks the error as an input error (exit code 3). Returns nil if the error is nil.
+ */
+func inputError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: exitInput, err: err}
+}
+
+/*
+Marks the error as an output error (exit code 4). Returns nil if the error is nil.
+ */
+func outputError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: exitOutput, err: err}
+}
+
+/*
+Returns the exit code of the error: the marked one, or the default code.
+ */
+func exitCode(err error, defaultCode int) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return defaultCode
+}
+
+/*
+Registers a function run before exiting, e.g. to remove temporary files.
+ */
+func addCleanup(fn func()) {
+	cleanups = append(cleanups, fn)
+}
+
+/*
+Runs the cleanup functions (the last registered first) and exits with the code.
+ */
+func exit(code int) {
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	cleanups = nil
+	os.Exit(code)
+}
+
+/*
+Logs the error message and exits with the code (after the cleanup).
+ */
+func fatal(code int, msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	exit(code)
+}
+
+/*
+If there is an error, logs it and exits with its code (see exitCode) after the cleanup.
+ */
+func fatalIfErr(err error, defaultCode int) {
+	if err != nil {
+		fatal(exitCode(err, defaultCode), err.Error())
+	}
+}
+
+/*
+If there is an error, logs it and carries on. The error makes the build fail with -strict.
+ */
+func printIfErr(err error, defaultCode int) {
+	if err != nil {
+		slog.Error(err.Error())
+		recordFailure(exitCode(err, defaultCode))
+	}
+}
+
+/*
+Records an error that did not stop the build.
+ */
+func recordFailure(code int) {
+	failures++
+	if failureCode == 0 {
+		failureCode = code
+	}
+}
+
+/*
+Logs a warning that is not related to a single image and adds it to the report.
+ */
+func warn(msg string, args ...interface{}) {
+	slog.Warn(msg, args...)
+	if report != nil { // nil before the setup
+		report.Warnings = append(report.Warnings, formatLogMessage(msg, args))
+	}
+}
+
+/*
+Logs a warning about the image and keeps it for the report.
+ */
+func (i *imagePlacemark) warn(msg string, args ...interface{}) {
+	slog.Warn(msg, append([]interface{}{"image", i.displayName()}, args...)...)
+	i.warnings = append(i.warnings, formatLogMessage(msg, args))
+}
+
+/*
+Logs an error of the image and keeps it for the report. The error makes the build fail with -strict.
+ */
+func (i *imagePlacemark) fail(err error, defaultCode int) {
+	if err == nil {
+		return
+	}
+	slog.Error(err.Error(), "image", i.displayName())
+	i.errors = append(i.errors, err.Error())
+	recordFailure(exitCode(err, defaultCode))
+}
+
+/*
+Returns the message with the key-value pairs, e.g. "cannot read file=a.jpg".
+ */
+func formatLogMessage(msg string, args []interface{}) string {
+	for i := 0; i+1 < len(args); i += 2 {
+		msg += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	return msg
+}
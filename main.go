@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"github.com/disintegration/imaging"
@@ -8,21 +9,29 @@ import (
 	"github.com/twpayne/go-kml"
 	"image/color"
 	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	filepath2 "path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// command (the first argument), empty for building the map
+var command string
+var availableCommands = []string{"inspect", "serve"}
+
 // flags
 var help bool
-var imgDir string
+var imgSpecs sourceSpecs
 var outDir string
 var dataFilepath string
 var sortByTime bool
 var genPath bool
+var trackFiles []string
+var pathPhotoLine bool
 var includeNoLocation bool
 var pathColorStr string
 var kmz bool
@@ -30,13 +39,75 @@ var mode string
 var base64images bool
 var name string
 var imageMaxSize int
+var outputFormat string
+var jpegQuality int
+var progressiveJpeg bool
+var sharpenSigma float64
+var resampleName string
+var iconMaxSize int
+var thumbFormat string
+var iconShape string
+var iconBorder string
+var iconShadow bool
+var watermarkText string
+var watermarkLogo string
+var watermarkPosition string
+var watermarkOpacity float64
+var watermarkScale float64
+var keepMetaStr string
+var pathSplitTime time.Duration
+var pathSplitDistance float64
+var pathSegmentMode string
+var pathJumpMode string
+var pathStyle string
+var pathSimplifyTolerance float64
+var pathSimplifyMethod string
+var pathSmoothWindow int
+var pathMinMove float64
+var strict bool
+var configFilepath string
+var profile string
+var includePatterns stringList
+var excludePatterns stringList
+var includeHidden bool
+var followSymlinks bool
+var fromStr string
+var toStr string
+var bboxStr string
+var polygonFilepath string
+var minRating int
+var requiredKeywords stringList
+var excludedKeywords stringList
+var duplicatesMode string
+var duplicatesHash string
+var duplicatesDistance int
+var duplicatesTime time.Duration
+var duplicatesRadius float64
+var dryRun bool
+var logFormat string
+var quiet bool
+var verbose bool
+var progressMode string
+var update bool
+var watch bool
+var watchInterval time.Duration
+var watchDebounce time.Duration
+var watchNetworkLink bool
+var serveAddr string
+var kmzOnly bool
+var appendFilepath string
+var appendFolder string
+var reportFilepath string
 
 // other global variables
 var tempDir string
-var dataFileItems dataArr
+var sources []*imageSource
+var includeRules []ignoreRule
+var excludeRules []ignoreRule
+var dataFileDefaults *dataRule
+var dataFileRules []*dataRule
 var isExternalPreferable = true
 var isExternalIconPreferable = false
-var iconMaxSize = 64
 
 var availableModes = map[string]func (el *kml.CompoundElement, img *imagePlacemark){
 	"g-earth-web": addGxCarouselPlacemark,
@@ -50,43 +121,146 @@ func init() {
 	flag.BoolVar(&help, "h", false, "")
 	flag.BoolVar(&help, "help", false, "")
 
-	flag.StringVar(&imgDir, "i", "", "Input directory with images (required)")
-	flag.StringVar(&outDir, "o", "", "Output directory for generated KML file and other copied files. Must be empty or not exist! (required)")
+	flag.Var(&imgSpecs, "i", "Input directory with images (required); can be repeated\n"+
+		"format: DIR[,label=LABEL][,color=RRGGBB][,path=BOOL]; DIR '-' reads a list of image files from stdin")
+	flag.StringVar(&outDir, "o", "", "Output directory for generated KML file and other copied files. Must be empty or not exist (unless -update)! (required)")
+	flag.BoolVar(&update, "update", false, "Update the output directory of a previous build: resize only changed images, remove files not needed anymore")
+	flag.BoolVar(&watch, "watch", false, "Keep running and update the output whenever the input images, the data file or other input files change")
+	flag.DurationVar(&watchInterval, "watch-interval", time.Second, "How often the inputs are checked for changes (-watch)")
+	flag.DurationVar(&watchDebounce, "watch-debounce", 2*time.Second, "Wait until there are no changes for the duration before rebuilding (-watch)")
+	flag.BoolVar(&watchNetworkLink, "watch-network-link", false, "Write network-link.kml, which reloads doc.kml periodically, into the output directory (-watch)")
+	flag.StringVar(&serveAddr, "addr", "localhost:8080", "Address of the HTTP server of the serve command")
+	flag.StringVar(&configFilepath, "config", "", fmt.Sprintf("Project configuration file (default: %s in the input directory, if it exists)", defaultConfigFilename))
+	flag.StringVar(&profile, "profile", "", "Profile from the configuration file to use")
+
+	flag.Var(&includePatterns, "include", "Use only images matching the glob pattern (can be repeated)")
+	flag.Var(&excludePatterns, "exclude", "Skip images and dirs matching the glob pattern (can be repeated)")
+	flag.BoolVar(&includeHidden, "hidden", false, "Do not skip hidden files and dirs (starting with a dot)")
+	flag.BoolVar(&followSymlinks, "follow-symlinks", false, "Follow symlinks to files and dirs")
 
 	flag.StringVar(&mode, "mode", "g-earth-web", fmt.Sprintf("Different apps use different types of image representation: %s", getModesKeys()))
-	flag.StringVar(&dataFilepath, "data", "", "JSON or YAML file with custom image information\n(it has higher priority than the EXIF info)")
+	flag.StringVar(&dataFilepath, "data", "", "JSON, YAML, CSV or TSV file with custom image information\n(it has higher priority than the EXIF info)")
 	flag.BoolVar(&sortByTime, "timesort", false, "Sort images by time (DateTimeOriginal eventually DateTime)")
-	flag.BoolVar(&genPath, "path", false, "Generate path (-timesort is recommended)")
+	flag.Var(pathFlag{}, "path", "Generate path (-timesort is recommended); -path=FILE draws a track from a GPX or GeoJSON file instead\n"+
+		"(can be repeated)")
+	flag.BoolVar(&pathPhotoLine, "path-photo-line", false, "Draw also the line connecting the images (thinner) when drawing a track")
 	flag.StringVar(&pathColorStr, "pathcolor", "00ff7fff", "Color of the path; format (hex): 'rrggbb' or 'rrggbbaa'")
+	flag.DurationVar(&pathSplitTime, "path-split-time", 0, "Split the path where the time between two images is longer, e.g. 3h (0 = never)")
+	flag.Float64Var(&pathSplitDistance, "path-split-distance", 0, "Split the path where the distance between two images is longer, in meters (0 = never)")
+	flag.StringVar(&pathSegmentMode, "path-segments", "multi", "Segments of a split path: multi (one placemark) or separate (a placemark for each)")
+	flag.StringVar(&pathJumpMode, "path-jumps", "none", "Jumps between the segments of a split path: none or arc (dashed great-circle arcs)")
+	flag.StringVar(&pathStyle, "path-style", "line", "Style of the path: line or track (gx:Track with time, animated by the time slider)")
+	flag.Float64Var(&pathSimplifyTolerance, "path-simplify", 0, "Simplify the path with the tolerance in meters (0 = no simplification)")
+	flag.StringVar(&pathSimplifyMethod, "path-simplify-method", "douglas-peucker", "Method of the simplification: douglas-peucker or visvalingam")
+	flag.IntVar(&pathSmoothWindow, "path-smooth", 0, "Smooth the path by a moving average of the number of points (0 = no smoothing)")
+	flag.Float64Var(&pathMinMove, "path-min-move", 0, "Leave out path points closer than the distance in meters to the previous one")
 	flag.BoolVar(&includeNoLocation, "include-no-location", false, "Do not skip images with no location (they are placed on [0,0])")
-	flag.BoolVar(&kmz, "kmz", false, "Create KMZ file (zip the output directory)")
+	flag.BoolVar(&kmz, "kmz", false, "Create KMZ file (doc.kml with the images)")
+	flag.BoolVar(&kmzOnly, "kmz-only", false, "Write only the KMZ file into the output directory (no doc.kml and image files)")
+	flag.StringVar(&appendFilepath, "append", "", "Append the images as a new folder to an existing KML or KMZ map and write the merged map into the output directory")
+	flag.StringVar(&appendFolder, "append-folder", "", "Name of the folder of the appended images (default: -name, or the label of the first source)")
 	flag.BoolVar(&base64images, "base64", false, "Embed images in base64 in the KML file")
 	flag.StringVar(&name, "name", "", "Project name")
 	flag.IntVar(&imageMaxSize, "maxsize", 1600, "Resize internal images to fit into a MAXSIZE x MAXSIZE box")
+	flag.StringVar(&outputFormat, "format", "keep", "Format of the resized images: keep (the format of the original), jpeg or png")
+	flag.IntVar(&jpegQuality, "quality", 75, "Quality of JPEG images and thumbnails (1-100)")
+	flag.BoolVar(&progressiveJpeg, "progressive", false, "Write progressive JPEG images and thumbnails (shown blurry first while loading)")
+	flag.Float64Var(&sharpenSigma, "sharpen", 0, "Sharpen images and thumbnails after resizing with the given sigma, e.g. 0.5 (0 = no sharpening)")
+	flag.StringVar(&resampleName, "resample", "lanczos", "Resample filter used for resizing: lanczos, catmullrom, mitchell, linear, box or nearest")
+	flag.IntVar(&iconMaxSize, "thumbsize", 64, "Resize thumbnails (icons) to fit into a THUMBSIZE x THUMBSIZE box")
+	flag.StringVar(&thumbFormat, "thumbformat", "png", "Format of the thumbnails: png or jpeg")
+	flag.StringVar(&iconShape, "icon-shape", "fit", "Shape of the icons: fit (the whole image), square, circle or rounded (square ones are cropped)")
+	flag.StringVar(&iconBorder, "icon-border", "source", "Border of the icons: none, source (color of the source), folder, day, camera or a color (rrggbb)")
+	flag.BoolVar(&iconShadow, "icon-shadow", false, "Add a drop shadow to the icons")
+	flag.StringVar(&watermarkText, "watermark-text", "", "Add the text as a watermark to the resized images")
+	flag.StringVar(&watermarkLogo, "watermark-logo", "", "Add the image (PNG with transparency) as a watermark to the resized images")
+	flag.StringVar(&watermarkPosition, "watermark-position", "bottom-right", "Position of the watermark: top-left, top, top-right, left, center, right, bottom-left, bottom or bottom-right")
+	flag.Float64Var(&watermarkOpacity, "watermark-opacity", 0.5, "Opacity of the watermark (0-1)")
+	flag.Float64Var(&watermarkScale, "watermark-scale", 0.2, "Width of the watermark relative to the width of the image (0-1)")
+	flag.StringVar(&keepMetaStr, "keep-meta", "", "Copy the metadata fields from the originals to the resized images, comma-separated: artist, copyright\n"+
+		"(from EXIF or IPTC; everything else, including the location, is removed)")
+	flag.BoolVar(&strict, "strict", false, "Fail if there is any problem in the data file or any error of an image (after the build)")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of the log: text or json (JSON lines)")
+	flag.BoolVar(&quiet, "quiet", false, "Log only errors")
+	flag.BoolVar(&verbose, "verbose", false, "Log also debug messages")
+	flag.StringVar(&progressMode, "progress", "auto", "Progress of the build: auto (bar on a terminal, log lines otherwise), bar, log,\n"+
+		"json (JSON lines events on the standard output) or none")
+
+	flag.StringVar(&fromStr, "from", "", "Use only images taken at or after the time (format: 2006-01-02 or 2006-01-02 15:04:05)")
+	flag.StringVar(&toStr, "to", "", "Use only images taken at or before the time (a date without time includes the whole day)")
+	flag.StringVar(&bboxStr, "bbox", "", "Use only images inside the bounding box: minLon,minLat,maxLon,maxLat")
+	flag.StringVar(&polygonFilepath, "polygon", "", "Use only images inside a polygon from the GeoJSON file")
+	flag.IntVar(&minRating, "min-rating", 0, "Use only images with at least the rating (EXIF or XMP, 1-5)")
+	flag.Var(&requiredKeywords, "keyword", "Use only images with the keyword (can be repeated, all are required)")
+	flag.Var(&excludedKeywords, "exclude-keyword", "Skip images with the keyword (can be repeated)")
+	flag.BoolVar(&dryRun, "dry-run", false, "Index and resolve everything, but write nothing (except the -report)")
+	flag.StringVar(&reportFilepath, "report", "", "Write a JSON report of the images (status, warnings, output paths) and totals to the file")
+	flag.StringVar(&duplicatesMode, "duplicates", "none", "Duplicate images: none (not searched for), report, first (keep the first), sharpest\n"+
+		"(keep the sharpest) or collapse (one placemark with all the images)")
+	flag.StringVar(&duplicatesHash, "duplicates-hash", "dhash", "Perceptual hash for near-duplicates: dhash, phash or none (only exact duplicates)")
+	flag.IntVar(&duplicatesDistance, "duplicates-distance", 6, "Maximum number of different bits of the perceptual hashes of near-duplicates (0-64)")
+	flag.DurationVar(&duplicatesTime, "duplicates-time", time.Hour, "Maximum time between near-duplicates (0 = any time, also no time)")
+	flag.Float64Var(&duplicatesRadius, "duplicates-radius", 100, "Maximum distance between near-duplicates in meters, if both have a location (0 = any distance)")
 }
 
 func main() {
-	flag.Parse()
+	parseCmd()
+	fatalIfErr(setupLogging(), exitUsage) // again in setup, the config file can change it
 	handleHelp()
+	loadConfig()
 	checkCmd()
+	if command == "serve" {
+		runServer()
+	}
 	setup()
+	if watch {
+		runWatch()
+	}
 
-	fmt.Println("Indexing images...")
-	images, err := indexImages(imgDir)
-	fatalIfErr(err)
+	images, err := indexImages(sources)
+	fatalIfErr(err, exitInput)
+	applyPrivacyZones(images)
+	allImages := images
+	images, filtered := filterImages(images)
 
-	tempDir, err = ioutil.TempDir("", "photo-map")
-	fatalIfErr(err)
-	defer func(){
-		err := os.RemoveAll(tempDir)
-		printIfErr(err)
-	}()
+	if command == "inspect" {
+		if sortByTime {
+			orderImagesByTime(allImages)
+		}
+		printInspection(allImages)
+		return
+	}
+	for _, img := range allImages {
+		if img.filtered != "" {
+			reportImage(img, "filtered")
+		}
+	}
+	allImages = nil // the placed images are freed one by one below
+
+	if !dryRun {
+		tempDir, err = ioutil.TempDir("", "photo-map")
+		fatalIfErr(err, exitOutput)
+		addCleanup(func() {
+			err := os.RemoveAll(tempDir)
+			if err != nil {
+				slog.Error(err.Error())
+			}
+		})
+	}
 
-	fmt.Println("Preparing images...")
-	createThumbnailsAndResized(images)
+	upToDate := findUpToDateImages(images)
+	images, failed := computeFingerprints(images)
+	images, duplicatesSummary := handleDuplicates(images, filtered)
+	images, failedFiles, refreshed := createThumbnailsAndResized(images)
+	failed += failedFiles
+	upToDate -= refreshed
+	assignImageIds(images)
 
-	fmt.Println("Generating KML document...")
+	progress := startProgress("kml", "Generating KML document", "images", len(images))
 	k, doc := getKmlDoc(name)
+	if appendMap != nil {
+		doc = appendMap.newFolder() // the images go into a folder of the existing map
+	}
 
 	if sortByTime {
 		orderImagesByTime(images)
@@ -96,61 +270,109 @@ func main() {
 		generatePath(images, doc)
 	}
 
+	folders := createSourceFolders(doc)
+
 	n := 1
-	for i, img := range images {
-		if base64images {
-			err := setBase64Image(img)
-			printIfErr(err)
-			err = setBase64Icon(img)
-			printIfErr(err)
+	noLocation := 0
+	for _, img := range images {
+		warnIfNoLocation(img)
+		if img.hasLocation || includeNoLocation {
+			reportImage(img, "placed")
 		} else {
-			collectFiles(img)
+			reportImage(img, "skipped-no-location")
+		}
+		if !dryRun && base64images {
+			embedImages(img)
+		}
+		if !img.hasLocation {
+			noLocation++
 		}
-		warnIfNoLocation(img)
 		if img.hasLocation || includeNoLocation {
 			img.description = img.dateTime.String()
 			img.name = strconv.Itoa(n)
 			n++
 
-			availableModes[mode](doc, img)
+			parent := doc
+			if folder, ok := folders[img.source]; ok {
+				parent = folder
+			}
+			availableModes[mode](parent, img)
 		}
-		images[i] = nil
+		progress.add(1)
 	}
+	progress.finish()
 
-	of, err := createFile(joinPaths(outDir, "doc.kml"))
-	fatalIfErr(err)
-	fatalIfErr(k.WriteIndent(of, "", "  "))
+	if !dryRun {
+		removed := writeOutput(k, doc, images)
+		if update {
+			slog.Info(fmt.Sprintf("Update: %d image(s) up to date, %d orphaned file(s) removed", upToDate, removed))
+		}
+	}
+	fatalIfErr(writeReport(), exitOutput)
 
-	if kmz {
-		fmt.Println("Creating KMZ file...")
-		zipFolderContents(outDir, joinPaths(outDir, "doc.kmz"))
+	if dryRun {
+		slog.Info("Done! (dry run, nothing written)")
+	} else {
+		slog.Info("Done!")
+	}
+	slog.Info(fmt.Sprintf("%d image(s) placed, %d without location, %s", n-1, noLocation, filteredSummary(filtered)))
+	if failed > 0 {
+		slog.Info(fmt.Sprintf("%d image(s) failed to decode", failed))
+	}
+	if duplicatesSummary != "" {
+		slog.Info("Duplicates: " + duplicatesSummary)
+	}
+	for _, summary := range pathSummaries {
+		slog.Info(summary)
+	}
+
+	if strict && failures > 0 {
+		fatal(failureCode, fmt.Sprintf("The build has %d error(s) (-strict)", failures))
 	}
-	fmt.Println("Done!")
+	exit(exitOK)
 }
 
 /*
-Checks the flags and arguments. If something is not right, fatal error is produced.
--i and -o flags are required, any additional arguments are forbidden.
+Parses the command (the first argument, if it is not a flag) and the flags.
+ */
+func parseCmd() {
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args) // exits on error
+}
+
+/*
+Checks the command, flags and arguments. If something is not right, fatal error is produced.
+-i flag is required (except for serve), -o flag is required when building the map or serving it, any additional
+arguments are forbidden.
 */
 func checkCmd() {
-	if imgDir == "" {
-		log.Println("The input directory is required: -i path/to/dir")
-		defer os.Exit(1)
+	if command != "" && !containsString(availableCommands, command) {
+		slog.Error(fmt.Sprintf("Unknown command: %s (available: %s)", command, strings.Join(availableCommands, ", ")))
+		defer exit(exitUsage)
+	}
+
+	if len(imgSpecs) == 0 && command != "serve" {
+		slog.Error("The input directory is required: -i path/to/dir")
+		defer exit(exitUsage)
 	}
 
-	if outDir == "" {
-		log.Println("The output directory is required: -o path/to/dir")
-		defer os.Exit(1)
+	if outDir == "" && (command == "" || command == "serve") {
+		slog.Error("The output directory is required: -o path/to/dir")
+		defer exit(exitUsage)
 	}
 
 	if _, ok := availableModes[mode]; !ok {
-		log.Println("Unknown mode: " + mode)
-		defer os.Exit(1)
+		slog.Error("Unknown mode: " + mode)
+		defer exit(exitUsage)
 	}
 
 	if flag.NArg() > 0 {
-		log.Println("Unexpected arguments: " + strings.Join(flag.Args(), " "))
-		defer os.Exit(1)
+		slog.Error("Unexpected arguments: " + strings.Join(flag.Args(), " "))
+		defer exit(exitUsage)
 	}
 }
 
@@ -163,6 +385,10 @@ func handleHelp() {
 		fmt.Println("An image gallery placed on a map!")
 		fmt.Println("\nSee https://github.com/sykoram/photo-map for documentation and more information.")
 		fmt.Println("\nUsage:")
+		fmt.Println("  photo-map [flags]          build the map")
+		fmt.Println("  photo-map inspect [flags]  print the resolved information about each image, write nothing")
+		fmt.Println("  photo-map serve [flags]    serve the output directory (-o) with a viewer and the build stats (-addr)")
+		fmt.Println("\nFlags:")
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
@@ -170,39 +396,58 @@ func handleHelp() {
 
 /*
 Setup:
-Normalizes paths, sets outFilesDir;
-Loads JSON or YAML file with custom image data if possible.
+Prepares the input sources, normalizes paths;
+Loads and validates JSON, YAML, CSV or TSV file with custom image data if possible.
  */
 func setup() {
-	imgDir = normalizePath(imgDir)
+	var err error
+	fatalIfErr(setupLogging(), exitUsage)
+	fatalIfErr(setupProgress(), exitUsage)
+	sources, err = prepareSources(imgSpecs)
+	fatalIfErr(err, exitUsage)
+	fatalIfErr(setupFilters(), exitUsage)
+	fatalIfErr(setupEncoding(), exitUsage)
+	fatalIfErr(setupIcons(), exitUsage)
+	fatalIfErr(setupWatermark(), exitUsage)
+	fatalIfErr(setupKeepMeta(), exitUsage)
+	fatalIfErr(setupPath(), exitUsage)
+	fatalIfErr(setupPathSimplification(), exitUsage)
+	fatalIfErr(setupDuplicates(), exitUsage)
+	setupReport()
+	includeRules, err = compilePatternList(includePatterns)
+	fatalIfErr(err, exitUsage)
+	excludeRules, err = compilePatternList(excludePatterns)
+	fatalIfErr(err, exitUsage)
 	outDir = normalizePath(outDir)
+	if kmzOnly {
+		kmz = true
+	}
+	fatalIfErr(setupAppend(), exitUsage)
+	fatalIfErr(setupUpdate(), exitUsage)
+	fatalIfErr(setupWatch(), exitUsage)
 
 	if dataFilepath != "" {
 		dataFilepath = normalizePath(dataFilepath)
 
-		var data dataObj
-		var err error
+		data, positions, err := loadDataFile(dataFilepath)
+		fatalIfErr(err, exitInput)
 
-		switch strings.ToLower(filepath2.Ext(dataFilepath)) {
-		case ".json":
-			data, err = loadJson(dataFilepath)
-			fatalIfErr(err)
-		case ".yaml":
-			data, err = loadYaml(dataFilepath)
-			fatalIfErr(err)
+		var problems []dataProblem
+		dataFileDefaults, dataFileRules, problems = validateDataFile(dataFilepath, data, positions, sources)
+		for _, p := range problems {
+			warn(p.String())
 		}
-
-		if data["items"] == nil {
-			log.Fatalln("Cannot find key 'items' in the data file.")
-		} else {
-			dataFileItems = data["items"].(dataArr)
+		if strict && len(problems) > 0 {
+			fatal(exitInput, fmt.Sprintf("The data file has %d problem(s).", len(problems)))
+		}
+		if dataFileRules == nil {
+			fatal(exitInput, "Cannot find array 'items' in the data file.")
 		}
 	}
 
-	var err error
 	pathLineColor, err = parseHexColor(pathColorStr)
 	if err != nil {
-		log.Fatalln("color-parsing error:", err)
+		fatal(exitUsage, "color-parsing error: "+err.Error())
 	}
 }
 
@@ -221,14 +466,20 @@ Converts a hex-string representation of a color to color.RGBA.
 
 /*
 Returns imagePlacemarks created using both internal and external images.
-Internal images are collected from the rootDir.
-Purely external images are loaded from the JSON or YAML data file.
+Internal images are collected from the sources.
+Purely external images are loaded from the data file.
 The returned structs have kmlPaths already set.
  */
-func indexImages(rootDir string) (images []*imagePlacemark, err error) {
-	images, err = getInternalImages(rootDir)
-	if err != nil {
-		return
+func indexImages(sources []*imageSource) (images []*imagePlacemark, err error) {
+	progress := startProgress("index", "Indexing images", "images", 0)
+	defer progress.finish()
+	images = make([]*imagePlacemark, 0)
+	for _, src := range sources {
+		srcImages, err := getInternalImages(src, progress)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, srcImages...)
 	}
 	externalImages, err := getExternalImages()
 	if err != nil {
@@ -243,60 +494,64 @@ func indexImages(rootDir string) (images []*imagePlacemark, err error) {
 }
 
 /*
-Searches the given dir, collects images returns them as image structs. .thumbnail dirs are ignored.
+Searches the dir of the source (or goes through its file list), collects images returns them as image structs.
+Every image is added to the progress.
+See walkSourceImages for the skipped files and the returned errors.
  */
-func getInternalImages(rootDir string) (images []*imagePlacemark, err error) {
-	rootDir = normalizePath(rootDir)
-	images = make([]*imagePlacemark, 0)
-
-	err = filepath2.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
-		path = normalizePath(path)
-		path = strings.TrimPrefix(path, rootDir+"/")
-		printIfErr(err)
-		if err != nil {
-			return nil
-		}
-
-		// skip .thumbnails
-		if strings.Contains(path, ".thumbnails") {
-			return filepath2.SkipDir
-		}
-
-		if info.Mode().IsRegular() && isImage(info) {
-			images = append(images, prepareInternalImage(rootDir, path))
-		}
-
-		return nil
-	})
-	return
+func getInternalImages(src *imageSource, progress *progress) (images []*imagePlacemark, err error) {
+	paths, err := listSourceImages(src)
+	if err != nil {
+		return nil, err
+	}
+	images = make([]*imagePlacemark, 0, len(paths))
+	for _, path := range paths {
+		images = append(images, prepareInternalImage(src, path))
+		progress.add(1)
+	}
+	return images, nil
 }
 
 /*
 Prepares an internal image struct: loads EXIF and JSON and sets properties
  */
-func prepareInternalImage(rootDir, rootRelPath string) *imagePlacemark {
+func prepareInternalImage(src *imageSource, rootRelPath string) *imagePlacemark {
 	img := imagePlacemark{
 		path:    rootRelPath,
-		rootDir: rootDir,
-		iconPath: joinPaths(".thumbnails", rootRelPath),  // the icon does not exit yet
+		origPath: rootRelPath,
+		rootDir: src.dir,
+		iconPath: thumbnailPath(rootRelPath),  // the icon does not exit yet
+		source:  src,
 	}
 	err := img.loadOrigExif(joinPaths(img.rootDir, img.path))
 	if err != nil && exif.IsCriticalError(err) {
-		log.Println("EXIF of", img.path, "has a critical error:", err)
+		if err == io.EOF || strings.Contains(err.Error(), "failed to find exif intro marker") {
+			slog.Debug("has no EXIF", "image", img.displayName())
+		} else {
+			img.warn("has a critical EXIF error", "error", err)
+		}
 	} else {
 		img.applyDataFromExif()
 	}
+	if needsRatingAndKeywords() {
+		img.fail(img.loadRatingAndKeywords(joinPaths(img.rootDir, img.path)), exitInput)
+	}
+	img.fail(img.loadFingerprint(joinPaths(img.rootDir, img.path)), exitInput)
+
+	// overwrite data from exif with data from the data file
+	data, rules := mergeMatchingRules(dataFileDefaults, dataFileRules, img.path)
+	if data != nil {
+		img.setCustomData(data)
+		img.applyCustomData()
+		img.setDataRules(rules)
+	}
 
-	// overwrite data from exif with data from json
-	if dataFileItems != nil {
-		for _, obj := range dataFileItems {
-			if f, ok := obj.(dataObj)["file"]; ok {
-				fs := normalizePath(f.(string))
-				if fs == img.path {
-					img.setCustomData(obj.(dataObj))
-					img.applyCustomData()
-				}
-			}
+	// show who took the photo if there are more sources
+	if len(sources) > 1 {
+		if img.properties == nil {
+			img.properties = dataObj{}
+		}
+		if _, ok := img.properties["source"]; !ok {
+			img.properties["source"] = src.label
 		}
 	}
 
@@ -308,15 +563,22 @@ Returns imagePlacemarks with purely external images loaded from the JSON/YAML fi
  */
 func getExternalImages() (images []*imagePlacemark, err error) {
 	images = make([]*imagePlacemark, 0)
-	if dataFileItems == nil {
-		return
-	}
-	for _, obj := range dataFileItems {
-		_, isExt := obj.(dataObj)["external"]
-		if _, isInt := obj.(dataObj)["file"]; isExt && !isInt { // only pure external images without local files
+	for _, rule := range dataFileRules {
+		_, isExt := rule.data["external"]
+		if _, isInt := rule.data["file"]; isExt && !isInt { // only pure external images without local files
+			rules := []*dataRule{rule}
+			if dataFileDefaults != nil {
+				rules = []*dataRule{dataFileDefaults, rule}
+			}
+			data := dataObj{}
+			for _, r := range rules {
+				mergeData(data, r.data)
+			}
+
 			img := imagePlacemark{}
-			img.setCustomData(obj.(dataObj))
+			img.setCustomData(data)
 			img.applyCustomData() // sets also externalPath
+			img.setDataRules(rules)
 			images = append(images, &img)
 		}
 	}
@@ -324,52 +586,228 @@ func getExternalImages() (images []*imagePlacemark, err error) {
 }
 
 /*
-Creates thumbnail and resized version in the tempDir. Sets image rootDir to the tempDir.
+Creates thumbnail and resized version in the tempDir (in a subdirectory for the source, if there are more sources).
+Sets image rootDir to the directory in the tempDir. In a dry run, the images are only decoded. Images that are
+up to date in the output directory (-update) are skipped, unless their count badge has changed. Collapsed duplicates
+get only the resized version.
+Returns the images without those that cannot be decoded, the number of such images and the number of up-to-date
+images created again.
  */
-func createThumbnailsAndResized(images []*imagePlacemark) {
-	for i, imgPm := range images {
-		if !imgPm.isInternal && !imgPm.isIconInternal {
-			continue
+func createThumbnailsAndResized(images []*imagePlacemark) (prepared []*imagePlacemark, failed, refreshed int) {
+	total := len(images)
+	for _, imgPm := range images {
+		total += len(imgPm.duplicates)
+	}
+	progress := startProgress("resize", "Preparing images", "images", total)
+	defer progress.finish()
+	prepared = make([]*imagePlacemark, 0, len(images))
+	for _, imgPm := range images {
+		if len(imgPm.duplicates) > 0 { // first, as the count badge depends on them
+			dups := imgPm.duplicates[:0]
+			for _, dup := range imgPm.duplicates {
+				progress.add(1)
+				if createImageFiles(dup, false) {
+					dups = append(dups, dup)
+				} else {
+					reportImage(dup, "failed-decode")
+					failed++
+				}
+			}
+			imgPm.duplicates = dups
+			imgPm.setCountBadge()
+		}
+		if imgPm.hasChangedCountBadge() {
+			imgPm.upToDate = false
+			refreshed++
 		}
 
-		img, err := imaging.Open(joinPaths(imgPm.rootDir, imgPm.path), imaging.AutoOrientation(true))
-		if err != nil {
-			printIfErr(err)
+		progress.add(1)
+		if !createImageFiles(imgPm, true) {
+			reportImage(imgPm, "failed-decode")
+			failed += 1 + len(imgPm.duplicates)
 			continue
 		}
+		prepared = append(prepared, imgPm)
+	}
+	return prepared, failed, refreshed
+}
+
+/*
+Creates thumbnail (if withIcon) and resized version of the image in the tempDir (see createThumbnailsAndResized).
+Returns false if the image cannot be decoded.
+ */
+func createImageFiles(imgPm *imagePlacemark, withIcon bool) bool {
+	if !imgPm.isInternal && !(withIcon && imgPm.isIconInternal) || imgPm.upToDate {
+		return true
+	}
+
+	img, err := imaging.Open(joinPaths(imgPm.rootDir, imgPm.path), imaging.AutoOrientation(true))
+	if err != nil {
+		imgPm.fail(err, exitInput)
+		return false
+	}
+
+	if dryRun {
+		return true
+	}
+	origRootDir := imgPm.rootDir
+	imgPm.rootDir = joinPaths(tempDir, imgPm.source.filesDir)
+
+	if imgPm.isInternal {
+		meta := imgPm.loadKeptMeta(joinPaths(origRootDir, imgPm.path))
+		resized := addWatermark(resizeImage(img, imageMaxSize))
+
+		imgPm.path = resizedImagePath(imgPm.path)  // the same as in pathInKml
+		err = createDir(filepath2.Dir(joinPaths(imgPm.rootDir, imgPm.path)))
+		if err == nil {
+			err = saveImage(resized, joinPaths(imgPm.rootDir, imgPm.path))
+		}
+		if err == nil {
+			err = writeImageMeta(joinPaths(imgPm.rootDir, imgPm.path), meta)
+		}
+		imgPm.fail(err, exitOutput)
+	}
 
-		images[i].rootDir = tempDir
+	if withIcon && imgPm.isIconInternal {
+		style := imgPm.drawnIconStyle()
+		thumbnail := createIcon(img, style, imgPm.iconBorderColor(style.border))
 
-		if imgPm.isInternal {
-			resized := imaging.Fit(img, imageMaxSize, imageMaxSize, imaging.Lanczos)
+		err = createDir(filepath2.Dir(joinPaths(imgPm.rootDir, imgPm.iconPath)))
+		if err == nil {
+			err = saveImage(thumbnail, joinPaths(imgPm.rootDir, imgPm.iconPath))
+		}
+		imgPm.fail(err, exitOutput)
+	}
+	return true
+}
+
+/*
+Writes doc.kml and the files of the images into the output directory (unless -kmz-only) and streams them into
+doc.kmz (with -kmz or -kmz-only), doc.kml first. With -append, doc.kml is the map with the folder (doc) of the images,
+and the files of the map are written too. Then writes the manifest, which removes orphaned files with -update.
+Returns the number of the removed files.
+ */
+func writeOutput(k, doc *kml.CompoundElement, images []*imagePlacemark) (removed int) {
+	var written []string // files in the output directory
+	content, err := renderKml(k, doc, images)
+	fatalIfErr(err, exitOutput)
+	if !kmzOnly {
+		fatalIfErr(outputError(writeKml(content, joinPaths(outDir, "doc.kml"))), exitOutput)
+		report.Kml = joinPaths(outDir, "doc.kml")
+		written = append(written, "doc.kml")
+	}
+	var kmzW *kmzWriter
+	if kmz {
+		kmzW, err = createKmz(joinPaths(outDir, "doc.kmz"))
+		fatalIfErr(outputError(err), exitOutput)
+		fatalIfErr(outputError(kmzW.addKml(content)), exitOutput)
+	}
+	if appendMap != nil {
+		files, err := appendMap.collectFiles(content, kmzW)
+		fatalIfErr(outputError(err), exitOutput)
+		written = append(written, files...)
+	}
 
-			err = createDir(filepath2.Dir(joinPaths(tempDir, imgPm.path)))
-			printIfErr(err)
-			err = imaging.Save(resized, joinPaths(tempDir, imgPm.path), imaging.JPEGQuality(75))
-			printIfErr(err)
+	label := "Copying files"
+	if kmz {
+		label = "Creating KMZ file"
+	}
+	progress := startProgress("write", label, "images", len(images))
+	for i, img := range images {
+		if !base64images {
+			collectFiles(img, kmzW)
+			if !kmzOnly {
+				addToManifest(img)
+			}
 		}
+		images[i] = nil // the files are written, the image can be freed
+		progress.add(1)
+	}
+	progress.finish()
 
-		if imgPm.isIconInternal {
-			thumbnail := imaging.Fit(img, iconMaxSize, iconMaxSize, imaging.Lanczos)
+	if kmzW != nil {
+		fatalIfErr(outputError(kmzW.close()), exitOutput)
+		report.Kmz = joinPaths(outDir, "doc.kmz")
+		written = append(written, "doc.kmz")
+	}
+	removed, err = writeManifest(written...)
+	fatalIfErr(err, exitOutput)
+	return removed
+}
+
+/*
+Writes the KML document into the file.
+ */
+func writeKml(content []byte, path string) error {
+	f, err := createFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
 
-			err = createDir(filepath2.Dir(joinPaths(tempDir, imgPm.iconPath)))
-			printIfErr(err)
-			images[i].iconPath += ".png"
-			err = imaging.Save(thumbnail, joinPaths(tempDir, imgPm.iconPath), imaging.JPEGQuality(75))
-			printIfErr(err)
+/*
+Returns the KML document: the KML element, or with -append the map with the folder (doc) of the images merged in.
+ */
+func renderKml(k, doc *kml.CompoundElement, images []*imagePlacemark) ([]byte, error) {
+	if appendMap == nil {
+		var buf bytes.Buffer
+		err := k.WriteIndent(&buf, "", "  ")
+		return buf.Bytes(), err
+	}
+	content, replaced, folderReplaced, err := appendMap.merge(doc, images)
+	if err == nil {
+		msg := fmt.Sprintf("Appended to %s as folder %q", appendMap.path, appendMap.folderName)
+		if folderReplaced {
+			msg += " (the folder of the same name has been replaced)"
 		}
+		slog.Info(fmt.Sprintf("%s, %d other placemark(s) replaced", msg, replaced))
 	}
+	return content, err
 }
 
 /*
-Copies resized image file or thumbnail from the tempDir to the output directory if necessary.
+Copies the resized image file and thumbnail of the image (and the resized files of its collapsed duplicates) from
+the tempDir to the output directory (unless -kmz-only, or they are up to date there), and adds them to the KMZ file
+(if it is not nil).
  */
-func collectFiles(img *imagePlacemark) {
+func collectFiles(img *imagePlacemark, kmzW *kmzWriter) {
+	collect := func(img *imagePlacemark, path, pathInKml string) {
+		src := joinPaths(img.rootDir, path)
+		if img.upToDate {
+			src = joinPaths(outDir, pathInKml)
+		} else if !kmzOnly {
+			img.fail(copyFile(src, joinPaths(outDir, pathInKml)), exitOutput)
+		}
+		if kmzW != nil {
+			img.fail(kmzW.addFile(pathInKml, src), exitOutput)
+		}
+	}
 	if img.isInternal {
-		printIfErr(copyFile(joinPaths(tempDir, img.path), joinPaths(outDir, img.pathInKml)))
+		collect(img, img.path, img.pathInKml)
 	}
 	if img.isIconInternal {
-		printIfErr(copyFile(joinPaths(tempDir, img.iconPath), joinPaths(outDir, img.iconPathInKml)))
+		collect(img, img.iconPath, img.iconPathInKml)
+	}
+	for _, dup := range img.duplicates {
+		if dup.isInternal {
+			collect(dup, dup.path, dup.pathInKml)
+		}
+	}
+}
+
+/*
+Sets base64 data of the image, its icon and its collapsed duplicates instead of their paths.
+ */
+func embedImages(img *imagePlacemark) {
+	img.fail(setBase64Image(img), exitOutput)
+	img.fail(setBase64Icon(img), exitOutput)
+	for _, dup := range img.duplicates {
+		dup.fail(setBase64Image(dup), exitOutput)
 	}
 }
 
@@ -379,13 +817,7 @@ Orders images by their timestamp. Warns if an image has no dateTime.
 func orderImagesByTime(images []*imagePlacemark) {
 	for _, img := range images {
 		if !img.hasDateTime {
-			path := ""
-			if img.isInternal {
-				path = img.path
-			} else {
-				path = img.externalPath
-			}
-			log.Printf("%s has no dateTime", path)
+			img.warn("has no dateTime")
 		}
 	}
 
@@ -395,20 +827,17 @@ func orderImagesByTime(images []*imagePlacemark) {
 }
 
 /*
-Generates a path (line) that connects the images.
-Images with no location are skipped.
+Creates a folder for each source in the document and returns them. Returns an empty map if there is only one source.
  */
-func generatePath(images []*imagePlacemark, doc *kml.CompoundElement) {
-	coords := make([]kml.Coordinate, 0)
-	for _, img := range images {
-		if img.hasLocation {
-			ic := kml.Coordinate{Lon: img.longitude, Lat: img.latitude}
-			if len(coords) == 0 || coords[len(coords)-1] != ic {  // ignore coordinates if same as previous
-				coords = append(coords, ic)
-			}
+func createSourceFolders(doc *kml.CompoundElement) map[*imageSource]*kml.CompoundElement {
+	folders := map[*imageSource]*kml.CompoundElement{}
+	if len(sources) > 1 {
+		for _, src := range sources {
+			folders[src] = kml.Folder(kml.Name(src.label))
+			doc.Add(folders[src])
 		}
 	}
-	createLine(doc, coords)
+	return folders
 }
 
 /*
@@ -458,13 +887,7 @@ Warns if the image has no location.
  */
 func warnIfNoLocation(img *imagePlacemark) {
 	if !img.hasLocation {
-		path := ""
-		if img.isInternal {
-			path = img.path
-		} else {
-			path = img.externalPath
-		}
-		log.Println(path, "has no location")
+		img.warn("has no location")
 	}
 }
 
@@ -480,19 +903,27 @@ func getModesKeys() []string {
 }
 
 /*
-If there is an error, produces fatal error (prints the error, exits with a code 1).
+Flag value that can be set repeatedly.
  */
-func fatalIfErr(err error) {
-	if err != nil {
-		log.Fatalln(err)
-	}
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
 
 /*
-If there is an error, prints it.
+Returns true if the slice contains the string.
  */
-func printIfErr(err error) {
-	if err != nil {
-		log.Println(err)
+func containsString(slice []string, s string) bool {
+	for _, x := range slice {
+		if x == s {
+			return true
+		}
 	}
+	return false
 }
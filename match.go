@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+Compiles a glob pattern to a regular expression that matches whole normalized paths.
+Supported are: * (any characters except /), ** (any characters including /), ? (one character except /),
+[...] and [!...] (character classes) and \ (escapes the next character).
+ */
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				i++
+				if i+1 < len(runes) && runes[i+1] == '/' { // **/ matches also no directory
+					i++
+					re.WriteString("(?:.*/)?")
+				} else {
+					re.WriteString(".*")
+				}
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := strings.IndexRune(string(runes[i+1:]), ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ] in %q", glob)
+			}
+			class := []rune(string(runes[i+1:])[:end])
+			i += len(class) + 1
+			re.WriteString("[")
+			if len(class) > 0 && class[0] == '!' {
+				re.WriteString("^")
+				class = class[1:]
+			}
+			re.WriteString(strings.ReplaceAll(string(class), `\`, `\\`))
+			re.WriteString("]")
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+			}
+			re.WriteString(regexp.QuoteMeta(string(runes[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
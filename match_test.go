@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		glob, path string
+		match      bool
+	}{
+		{"*.jpg", "a.jpg", true},
+		{"*.jpg", "day1/a.jpg", false},
+		{"**/*.jpg", "a.jpg", true},
+		{"**/*.jpg", "day1/day2/a.jpg", true},
+		{"italy/**", "italy/day1/a.jpg", true},
+		{"IMG_00?.jpg", "IMG_001.jpg", true},
+		{"IMG_00?.jpg", "IMG_0010.jpg", false},
+		{"day[12]/*.jpg", "day2/a.jpg", true},
+		{"day[!12]/*.jpg", "day2/a.jpg", false},
+		{"day[!12]/*.jpg", "day3/a.jpg", true},
+		{`IMG\[1\].jpg`, "IMG[1].jpg", true},
+		{`IMG\[1\].jpg`, "IMG1.jpg", false},
+		{"a+b (1).jpg", "a+b (1).jpg", true},
+	}
+	for _, test := range tests {
+		re, err := compileGlob(test.glob)
+		if err != nil {
+			t.Errorf("%s: %v", test.glob, err)
+			continue
+		}
+		if re.MatchString(test.path) != test.match {
+			t.Errorf("%s matches %s: %v, want %v", test.glob, test.path, !test.match, test.match)
+		}
+	}
+	if _, err := compileGlob("day[1.jpg"); err == nil {
+		t.Error("no error for a missing ]")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/rwcarlsen/goexif/exif"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var keepMetaFields = []string{"artist", "copyright"}
+
+var keepMeta []string // fields of -keep-meta (set in setupKeepMeta)
+
+const (
+	iptcByLine    = 80  // 2:80 By-line
+	iptcCopyright = 116 // 2:116 Copyright Notice
+)
+
+/*
+Metadata copied from the original image to the resized one (see -keep-meta).
+ */
+type imageMeta struct {
+	artist    string
+	copyright string
+}
+
+func (m imageMeta) isEmpty() bool {
+	return m.artist == "" && m.copyright == ""
+}
+
+/*
+Checks the -keep-meta flag. Returns an error if it is invalid.
+ */
+func setupKeepMeta() error {
+	keepMeta = nil
+	for _, field := range strings.Split(keepMetaStr, ",") {
+		if field = strings.ToLower(strings.TrimSpace(field)); field == "" {
+			continue
+		}
+		keepMeta = append(keepMeta, field)
+		if !containsString(keepMetaFields, field) {
+			return fmt.Errorf("-keep-meta: unknown field %q (use %s)", field, strings.Join(keepMetaFields, ", "))
+		}
+	}
+	return nil
+}
+
+/*
+Returns the metadata of the image selected by -keep-meta: from the EXIF (Artist, Copyright) or, if missing,
+from the IPTC (By-line, Copyright Notice).
+ */
+func (i *imagePlacemark) loadKeptMeta(filepath string) imageMeta {
+	var meta imageMeta
+	if len(keepMeta) == 0 {
+		return meta
+	}
+	if i.origExif != nil {
+		meta.artist = exifString(i.origExif, exif.Artist)
+		meta.copyright = exifString(i.origExif, exif.Copyright)
+	}
+	if meta.artist == "" || meta.copyright == "" {
+		iptc, err := readIptc(filepath)
+		i.fail(err, exitInput)
+		if meta.artist == "" {
+			meta.artist = iptc[iptcByLine]
+		}
+		if meta.copyright == "" {
+			meta.copyright = iptc[iptcCopyright]
+		}
+	}
+	if !containsString(keepMeta, "artist") {
+		meta.artist = ""
+	}
+	if !containsString(keepMeta, "copyright") {
+		meta.copyright = ""
+	}
+	return meta
+}
+
+/*
+Returns the string value of the EXIF field, or an empty string.
+ */
+func exifString(x *exif.Exif, field exif.FieldName) string {
+	tag, err := x.Get(field)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(s, "\x00 ")
+}
+
+/*
+Reads the IPTC datasets of the record 2 (dataset number -> value) from the APP13 segment of a JPEG file.
+Returns an empty map if the file is not a JPEG or has no IPTC.
+ */
+func readIptc(filepath string) (map[int]string, error) {
+	datasets := map[int]string{}
+	f, err := os.Open(filepath)
+	if err != nil {
+		return datasets, err
+	}
+	defer f.Close()
+
+	head, err := ioutil.ReadAll(io.LimitReader(f, xmpMaxOffset))
+	if err != nil {
+		return datasets, err
+	}
+	if len(head) < 2 || head[0] != 0xff || head[1] != 0xd8 {
+		return datasets, nil
+	}
+	for pos := 2; pos+4 <= len(head) && head[pos] == 0xff; {
+		marker := head[pos+1]
+		if marker == 0xda || marker == 0xd9 { // start of scan or end of image
+			break
+		}
+		length := int(binary.BigEndian.Uint16(head[pos+2:]))
+		end := pos + 2 + length
+		if end > len(head) {
+			break
+		}
+		if marker == 0xed { // APP13
+			parseIptcResources(head[pos+4:end], datasets)
+		}
+		pos = end
+	}
+	return datasets, nil
+}
+
+/*
+Parses Photoshop image resources of an APP13 segment and adds the IPTC datasets of the record 2 to the map.
+ */
+func parseIptcResources(segment []byte, datasets map[int]string) {
+	const header = "Photoshop 3.0\x00"
+	if !bytes.HasPrefix(segment, []byte(header)) {
+		return
+	}
+	data := segment[len(header):]
+	for len(data) >= 12 && string(data[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(data[4:])
+		nameLen := int(data[6])
+		n := 7 + nameLen
+		if n%2 == 1 { // the name is padded to even size
+			n++
+		}
+		if n+4 > len(data) {
+			return
+		}
+		size := int(binary.BigEndian.Uint32(data[n:]))
+		n += 4
+		if n+size > len(data) {
+			return
+		}
+		if id == 0x0404 {
+			iptc := data[n : n+size]
+			for len(iptc) >= 5 && iptc[0] == 0x1c {
+				record, number := iptc[1], iptc[2]
+				valueLen := int(binary.BigEndian.Uint16(iptc[3:]))
+				if 5+valueLen > len(iptc) {
+					break
+				}
+				if record == 2 {
+					datasets[int(number)] = strings.TrimSpace(string(iptc[5 : 5+valueLen]))
+				}
+				iptc = iptc[5+valueLen:]
+			}
+		}
+		if size%2 == 1 {
+			size++
+		}
+		if n+size > len(data) {
+			return
+		}
+		data = data[n+size:]
+	}
+}
+
+/*
+Writes the metadata into the saved image file: EXIF and IPTC segments into a JPEG, tEXt chunks into a PNG.
+Other formats are left as they are.
+ */
+func writeImageMeta(filepath string, meta imageMeta) error {
+	if meta.isEmpty() {
+		return nil
+	}
+	content, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return err
+	}
+	var out []byte
+	switch {
+	case hasFormatExt(filepath, "jpeg") && bytes.HasPrefix(content, []byte{0xff, 0xd8}):
+		out = append(out, content[:2]...) // SOI
+		out = append(out, jpegSegment(0xe1, append([]byte("Exif\x00\x00"), exifTiff(meta)...))...)
+		out = append(out, jpegSegment(0xed, photoshopIptc(meta))...)
+		out = append(out, content[2:]...)
+	case hasFormatExt(filepath, "png") && len(content) >= 33:
+		out = append(out, content[:33]...) // signature and IHDR
+		if meta.artist != "" {
+			out = append(out, pngChunk("tEXt", []byte("Author\x00"+meta.artist))...)
+		}
+		if meta.copyright != "" {
+			out = append(out, pngChunk("tEXt", []byte("Copyright\x00"+meta.copyright))...)
+		}
+		out = append(out, content[33:]...)
+	default:
+		return nil
+	}
+	return ioutil.WriteFile(filepath, out, 0644)
+}
+
+/*
+Returns a JPEG marker segment with the data.
+ */
+func jpegSegment(marker byte, data []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(data)+2))
+	return append(segment, data...)
+}
+
+/*
+Returns a little-endian TIFF structure with the IFD0 containing Artist and Copyright.
+ */
+func exifTiff(meta imageMeta) []byte {
+	type entry struct {
+		tag   uint16
+		value string
+	}
+	var entries []entry // sorted by tag
+	if meta.artist != "" {
+		entries = append(entries, entry{0x013b, meta.artist})
+	}
+	if meta.copyright != "" {
+		entries = append(entries, entry{0x8298, meta.copyright})
+	}
+
+	le := binary.LittleEndian
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	dataOffset := 8 + 2 + 12*len(entries) + 4
+	var ifd, data []byte
+	ifd = le.AppendUint16(ifd, uint16(len(entries)))
+	for _, e := range entries {
+		value := append([]byte(e.value), 0)
+		ifd = le.AppendUint16(ifd, e.tag)
+		ifd = le.AppendUint16(ifd, 2) // ASCII
+		ifd = le.AppendUint32(ifd, uint32(len(value)))
+		if len(value) <= 4 {
+			ifd = append(ifd, append(value, make([]byte, 4-len(value))...)...)
+		} else {
+			ifd = le.AppendUint32(ifd, uint32(dataOffset+len(data)))
+			data = append(data, value...)
+			if len(data)%2 == 1 {
+				data = append(data, 0)
+			}
+		}
+	}
+	ifd = le.AppendUint32(ifd, 0) // no next IFD
+	return append(append(tiff, ifd...), data...)
+}
+
+/*
+Returns an APP13 segment data with IPTC By-line and Copyright Notice (in UTF-8).
+ */
+func photoshopIptc(meta imageMeta) []byte {
+	dataset := func(record, number byte, value string) []byte {
+		d := []byte{0x1c, record, number, 0, 0}
+		binary.BigEndian.PutUint16(d[3:], uint16(len(value)))
+		return append(d, value...)
+	}
+	iptc := dataset(1, 90, "\x1b%G") // coded character set: UTF-8
+	iptc = append(iptc, dataset(2, 0, "\x00\x04")...)
+	if meta.artist != "" {
+		iptc = append(iptc, dataset(2, iptcByLine, meta.artist)...)
+	}
+	if meta.copyright != "" {
+		iptc = append(iptc, dataset(2, iptcCopyright, meta.copyright)...)
+	}
+
+	out := []byte("Photoshop 3.0\x008BIM\x04\x04\x00\x00")
+	out = binary.BigEndian.AppendUint32(out, uint32(len(iptc)))
+	out = append(out, iptc...)
+	if len(iptc)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+/*
+Returns a PNG chunk of the type with the data.
+ */
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
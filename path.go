@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"github.com/twpayne/go-kml"
+	"image/color"
+	"math"
+	"strings"
+	"time"
+)
+
+var pathSegmentModes = []string{"multi", "separate"}
+var pathJumpModes = []string{"none", "arc"}
+var pathStyles = []string{"line", "track"}
+
+var pathJumpDashLength = 20000.0 // approximate length of a dash (and a space) of a jump arc in meters
+var pathJumpMaxDashes = 200
+
+/*
+A point of a path.
+ */
+type pathPoint struct {
+	lonLat
+	alt     float64
+	hasAlt  bool
+	time    time.Time
+	hasTime bool
+}
+
+/*
+A continuous part of a path.
+ */
+type pathSegment []pathPoint
+
+/*
+A gap between two segments of a path (the path was split because of the time or the distance).
+ */
+type pathJump struct {
+	from, to pathPoint
+}
+
+/*
+Checks the path flags. Returns an error if any of them is invalid.
+ */
+func setupPath() error {
+	var err error
+	tracks, err = loadTracks(trackFiles)
+	if err != nil {
+		return inputError(fmt.Errorf("-path: %w", err))
+	}
+	if pathSplitTime < 0 {
+		return fmt.Errorf("-path-split-time cannot be negative")
+	}
+	if pathSplitDistance < 0 {
+		return fmt.Errorf("-path-split-distance cannot be negative")
+	}
+	if !containsString(pathSegmentModes, pathSegmentMode) {
+		return fmt.Errorf("-path-segments has to be one of: %s", strings.Join(pathSegmentModes, ", "))
+	}
+	if !containsString(pathJumpModes, pathJumpMode) {
+		return fmt.Errorf("-path-jumps has to be one of: %s", strings.Join(pathJumpModes, ", "))
+	}
+	if !containsString(pathStyles, pathStyle) {
+		return fmt.Errorf("-path-style has to be one of: %s", strings.Join(pathStyles, ", "))
+	}
+	return nil
+}
+
+/*
+Generates a path (line) that connects the images.
+If there are more sources, each source with drawPath has its own path connecting only its images.
+Images with no location are skipped. The path is interrupted by privacy zones, and split into segments
+by the time and distance gaps.
+If there are track files, the track (trimmed to the time span of the images) is drawn instead,
+and the line connecting the images only with -path-photo-line (thinner).
+ */
+func generatePath(images []*imagePlacemark, doc *kml.CompoundElement) {
+	width := pathLineWidth
+	if len(tracks) > 0 {
+		createPath(doc, trackName, pathLineColor, width, cutPrivacyZones(trimTracks(tracks, images)), nil)
+		if !pathPhotoLine {
+			return
+		}
+		width = photoLineWidth
+	}
+
+	if len(sources) == 1 {
+		src := sources[0]
+		if src.drawPath {
+			segments, jumps := pathSegments(images, nil)
+			createPath(doc, pathName, sourcePathColor(src), width, segments, jumps)
+		}
+		return
+	}
+
+	for _, src := range sources {
+		if src.drawPath {
+			segments, jumps := pathSegments(images, src)
+			createPath(doc, pathName+" ("+src.label+")", sourcePathColor(src), width, segments, jumps)
+		}
+	}
+}
+
+/*
+Creates the path from the segments: as one MultiGeometry or separate placemarks (-path-segments),
+and the jumps between them (-path-jumps). The statistics are added to the placemarks and to pathSummaries.
+ */
+func createPath(el *kml.CompoundElement, name string, lineColor color.RGBA, width float64, segments []pathSegment, jumps []pathJump) {
+	if len(segments) == 0 {
+		return
+	}
+	segmentStats := make([]pathStats, len(segments))
+	var total pathStats
+	for i, segment := range segments {
+		segmentStats[i] = segment.stats()
+		total.add(segmentStats[i])
+	}
+	pathSummaries = append(pathSummaries, fmt.Sprintf("%s: %s", name, total))
+
+	if pathSegmentMode == "separate" && len(segments) > 1 {
+		for i, segment := range segments {
+			createLine(el, fmt.Sprintf("%s %d", name, i+1), lineColor, width, segment.geometries(),
+				pathStatsElements(segmentStats[i], nil)...)
+		}
+	} else {
+		var geometries []kml.Element
+		for _, segment := range segments {
+			geometries = append(geometries, segment.geometries()...)
+		}
+		createLine(el, name, lineColor, width, geometries, pathStatsElements(total, segmentStats)...)
+	}
+
+	if pathJumpMode == "arc" {
+		var dashes []kml.Element
+		for _, jump := range jumps {
+			for _, dash := range jumpDashes(jump) {
+				dashes = append(dashes, lineString(dash))
+			}
+		}
+		createLine(el, name+" - jumps", lineColor, width, dashes)
+	}
+}
+
+/*
+Returns the segments of the path of the located images (only of the source, if it is not nil), and the jumps
+between them. Images in privacy zones are left out and the path is split wherever it would enter a zone
+(such splits are not jumps). A segment with a single point is left out.
+ */
+func pathSegments(images []*imagePlacemark, src *imageSource) (segments []pathSegment, jumps []pathJump) {
+	var segment pathSegment
+	endSegment := func() {
+		if len(segment) > 1 {
+			segments = append(segments, segment)
+		}
+		segment = nil
+	}
+	for _, img := range images {
+		if !img.hasLocation || (src != nil && img.source != src) {
+			continue
+		}
+		if img.privacyZone != nil {
+			endSegment()
+			continue
+		}
+		p := pathPoint{
+			lonLat:  lonLat{img.longitude, img.latitude},
+			alt:     img.altitude,
+			hasAlt:  img.hasAltitude,
+			time:    img.dateTime,
+			hasTime: img.hasDateTime,
+		}
+		if len(segment) > 0 {
+			last := segment[len(segment)-1]
+			if last.lonLat == p.lonLat {  // ignore coordinates if same as previous
+				continue
+			}
+			if segmentEntersPrivacyZone(last.lonLat, p.lonLat) {
+				endSegment()
+			} else if isPathGap(last, p) {
+				endSegment()
+				jumps = append(jumps, pathJump{from: last, to: p})
+			}
+		}
+		segment = append(segment, p)
+	}
+	endSegment()
+	return segments, jumps
+}
+
+/*
+Returns true if the path has to be split between the points (-path-split-time, -path-split-distance).
+ */
+func isPathGap(a, b pathPoint) bool {
+	if pathSplitTime > 0 && a.hasTime && b.hasTime && b.time.Sub(a.time) > pathSplitTime {
+		return true
+	}
+	return pathSplitDistance > 0 && distance(a.lonLat, b.lonLat) > pathSplitDistance
+}
+
+/*
+Returns the geometries of the segment, lightened for drawing (see lightened): a LineString, or with
+-path-style track gx:Tracks of the parts with time and LineStrings of the parts without it.
+ */
+func (s pathSegment) geometries() []kml.Element {
+	s = s.lightened()
+	if pathStyle != "track" {
+		return []kml.Element{lineString(s.coordinates())}
+	}
+
+	var geometries []kml.Element
+	for start := 0; start < len(s); {
+		end := start + 1
+		for end < len(s) && s[end].hasTime == s[start].hasTime {
+			end++
+		}
+		if s[start].hasTime {
+			if end-start > 1 {
+				geometries = append(geometries, gxTrack(s[start:end]))
+			}
+		} else {
+			// connected to the neighboring points with time, so the line is not interrupted
+			from, to := maxInt(0, start-1), minInt(len(s), end+1)
+			geometries = append(geometries, lineString(s[from:to].coordinates()))
+		}
+		start = end
+	}
+	return geometries
+}
+
+/*
+Returns the KML coordinates of the segment.
+ */
+func (s pathSegment) coordinates() []kml.Coordinate {
+	coords := make([]kml.Coordinate, len(s))
+	for i, p := range s {
+		coords[i] = kml.Coordinate{Lon: p.lonLat[0], Lat: p.lonLat[1]}
+	}
+	return coords
+}
+
+/*
+Returns the jump as a dashed great-circle arc: a list of short lines. Dashes entering a privacy zone are left out.
+ */
+func jumpDashes(jump pathJump) [][]kml.Coordinate {
+	d := distance(jump.from.lonLat, jump.to.lonLat)
+	n := int(math.Max(2, math.Min(float64(pathJumpMaxDashes), math.Round(d/pathJumpDashLength)))) // dashes
+	var dashes [][]kml.Coordinate
+	for i := 0; i < n; i++ {
+		a := greatCirclePoint(jump.from.lonLat, jump.to.lonLat, float64(2*i)/float64(2*n-1))
+		b := greatCirclePoint(jump.from.lonLat, jump.to.lonLat, float64(2*i+1)/float64(2*n-1))
+		if !segmentEntersPrivacyZone(a, b) {
+			dashes = append(dashes, []kml.Coordinate{{Lon: a[0], Lat: a[1]}, {Lon: b[0], Lat: b[1]}})
+		}
+	}
+	return dashes
+}
+
+/*
+Returns the color of the source's path: its own color if set, otherwise the -pathcolor.
+ */
+func sourcePathColor(src *imageSource) color.RGBA {
+	if src.color != nil {
+		return *src.color
+	}
+	return pathLineColor
+}
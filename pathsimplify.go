@@ -0,0 +1,268 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var pathSimplifyMethods = []string{"douglas-peucker", "visvalingam"}
+
+/*
+Checks the flags of path simplification. Returns an error if any of them is invalid.
+ */
+func setupPathSimplification() error {
+	if pathSimplifyTolerance < 0 {
+		return fmt.Errorf("-path-simplify cannot be negative")
+	}
+	if !containsString(pathSimplifyMethods, pathSimplifyMethod) {
+		return fmt.Errorf("-path-simplify-method has to be one of: %s", strings.Join(pathSimplifyMethods, ", "))
+	}
+	if pathSmoothWindow < 0 {
+		return fmt.Errorf("-path-smooth cannot be negative")
+	}
+	if pathMinMove < 0 {
+		return fmt.Errorf("-path-min-move cannot be negative")
+	}
+	return nil
+}
+
+/*
+Returns the segment lightened for drawing: points closer than -path-min-move to the previous one are dropped,
+the rest is smoothed by a moving average (-path-smooth) and simplified (-path-simplify).
+The first and the last point are kept, and no line entering a privacy zone is created.
+ */
+func (s pathSegment) lightened() pathSegment {
+	if pathMinMove > 0 {
+		s = s.withoutSmallMoves(pathMinMove)
+	}
+	if pathSmoothWindow > 1 {
+		s = s.smoothed(pathSmoothWindow)
+	}
+	if pathSimplifyTolerance > 0 {
+		if pathSimplifyMethod == "visvalingam" {
+			s = s.visvalingam(pathSimplifyTolerance)
+		} else {
+			s = s.douglasPeucker(pathSimplifyTolerance)
+		}
+	}
+	return s
+}
+
+/*
+Returns the segment without points closer than minMove meters to the previously kept point.
+ */
+func (s pathSegment) withoutSmallMoves(minMove float64) pathSegment {
+	if len(s) < 3 {
+		return s
+	}
+	out := pathSegment{s[0]}
+	for i := 1; i < len(s)-1; i++ {
+		last := out[len(out)-1]
+		if distance(last.lonLat, s[i].lonLat) >= minMove || segmentEntersPrivacyZone(last.lonLat, s[i+1].lonLat) {
+			out = append(out, s[i])
+		}
+	}
+	return append(out, s[len(s)-1])
+}
+
+/*
+Returns the segment smoothed by a centered moving average of the window (number of points).
+A point is left as it is if its smoothed position would be in a privacy zone.
+ */
+func (s pathSegment) smoothed(window int) pathSegment {
+	out := make(pathSegment, len(s))
+	copy(out, s)
+	half := window / 2
+	for i := 1; i < len(s)-1; i++ {
+		from, to := maxInt(0, i-half), minInt(len(s)-1, i+window-1-half)
+		var lon, lat float64
+		for j := from; j <= to; j++ {
+			lon += s[j].lonLat[0]
+			lat += s[j].lonLat[1]
+		}
+		n := float64(to - from + 1)
+		p := lonLat{lon / n, lat / n}
+		if !segmentEntersPrivacyZone(out[i-1].lonLat, p) && !segmentEntersPrivacyZone(p, s[i+1].lonLat) {
+			out[i].lonLat = p
+		}
+	}
+	return out
+}
+
+/*
+Returns the segment simplified by the Douglas-Peucker algorithm: the points closer than the tolerance (meters)
+to the simplified line are dropped.
+ */
+func (s pathSegment) douglasPeucker(tolerance float64) pathSegment {
+	if len(s) < 3 {
+		return s
+	}
+	proj := newLocalProjection(s)
+	keep := make([]bool, len(s))
+	keep[0], keep[len(s)-1] = true, true
+
+	var simplify func(first, last int)
+	simplify = func(first, last int) {
+		if last-first < 2 {
+			return
+		}
+		farthest, maxDist := -1, -1.0
+		for i := first + 1; i < last; i++ {
+			if d := proj.segmentDistance(s[i].lonLat, s[first].lonLat, s[last].lonLat); d > maxDist {
+				farthest, maxDist = i, d
+			}
+		}
+		if maxDist > tolerance || segmentEntersPrivacyZone(s[first].lonLat, s[last].lonLat) {
+			keep[farthest] = true
+			simplify(first, farthest)
+			simplify(farthest, last)
+		}
+	}
+	simplify(0, len(s)-1)
+
+	var out pathSegment
+	for i, p := range s {
+		if keep[i] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+/*
+Returns the segment simplified by the Visvalingam-Whyatt algorithm: the point forming the smallest triangle
+with its neighbors is dropped repeatedly. Only points closer than the tolerance (meters) to the line between
+their neighbors can be dropped. The points are kept in a min-heap by their areas and linked to their neighbors,
+so a drop updates only the two neighbors (O(n log n)).
+ */
+func (s pathSegment) visvalingam(tolerance float64) pathSegment {
+	if len(s) < 3 {
+		return s
+	}
+	proj := newLocalProjection(s)
+	prev, next := make([]int, len(s)), make([]int, len(s))
+	version := make([]int, len(s)) // of the current heap entry of the point, older entries are stale
+	dropped := make([]bool, len(s))
+	h := &visvalingamHeap{}
+
+	// pushes the point with its current neighbors, if it can be dropped
+	update := func(i int) {
+		if i == 0 || i == len(s)-1 {
+			return
+		}
+		version[i]++
+		a, p, b := s[prev[i]].lonLat, s[i].lonLat, s[next[i]].lonLat
+		if proj.segmentDistance(p, a, b) >= tolerance || segmentEntersPrivacyZone(a, b) {
+			return
+		}
+		heap.Push(h, visvalingamEntry{index: i, area: proj.triangleArea(a, p, b), version: version[i]})
+	}
+	for i := range s {
+		prev[i], next[i] = i-1, i+1
+	}
+	for i := 1; i < len(s)-1; i++ {
+		update(i)
+	}
+
+	for h.Len() > 0 {
+		e := heap.Pop(h).(visvalingamEntry)
+		if dropped[e.index] || e.version != version[e.index] {
+			continue
+		}
+		dropped[e.index] = true
+		p, n := prev[e.index], next[e.index]
+		next[p], prev[n] = n, p
+		update(p)
+		update(n)
+	}
+
+	var out pathSegment
+	for i, p := range s {
+		if !dropped[i] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+/*
+A point of the Visvalingam-Whyatt algorithm with the area of its triangle.
+ */
+type visvalingamEntry struct {
+	index   int
+	area    float64
+	version int
+}
+
+/*
+A min-heap of the points by their areas (and indexes, so that the result does not depend on the heap order).
+ */
+type visvalingamHeap []visvalingamEntry
+
+func (h visvalingamHeap) Len() int { return len(h) }
+func (h visvalingamHeap) Less(i, j int) bool {
+	return h[i].area < h[j].area || h[i].area == h[j].area && h[i].index < h[j].index
+}
+func (h visvalingamHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *visvalingamHeap) Push(x interface{}) { *h = append(*h, x.(visvalingamEntry)) }
+func (h *visvalingamHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+/*
+An equirectangular projection to meters around a point, precise enough for the short distances of a path.
+ */
+type localProjection struct {
+	origin lonLat
+	cosLat float64
+}
+
+/*
+Returns a projection around the first point of the segment.
+ */
+func newLocalProjection(s pathSegment) localProjection {
+	return localProjection{origin: s[0].lonLat, cosLat: math.Cos(s[0].lonLat[1] * math.Pi / 180)}
+}
+
+/*
+Returns the point projected to meters.
+ */
+func (proj localProjection) project(p lonLat) (x, y float64) {
+	dLon := p[0] - proj.origin[0]
+	if dLon > 180 { // across the antimeridian
+		dLon -= 360
+	} else if dLon < -180 {
+		dLon += 360
+	}
+	return dLon * math.Pi / 180 * earthRadius * proj.cosLat, (p[1] - proj.origin[1]) * math.Pi / 180 * earthRadius
+}
+
+/*
+Returns the distance of the point p from the line segment ab in meters.
+ */
+func (proj localProjection) segmentDistance(p, a, b lonLat) float64 {
+	px, py := proj.project(p)
+	ax, ay := proj.project(a)
+	bx, by := proj.project(b)
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if lenSq := dx*dx + dy*dy; lenSq > 0 {
+		t = math.Max(0, math.Min(1, ((px-ax)*dx+(py-ay)*dy)/lenSq))
+	}
+	return math.Hypot(px-(ax+t*dx), py-(ay+t*dy))
+}
+
+/*
+Returns the area of the triangle in square meters.
+ */
+func (proj localProjection) triangleArea(a, b, c lonLat) float64 {
+	ax, ay := proj.project(a)
+	bx, by := proj.project(b)
+	cx, cy := proj.project(c)
+	return math.Abs((bx-ax)*(cy-ay)-(cx-ax)*(by-ay)) / 2
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+The straightforward O(n²) Visvalingam-Whyatt algorithm, the reference for the heap-based one.
+ */
+func visvalingamReference(s pathSegment, tolerance float64) pathSegment {
+	proj := newLocalProjection(s)
+	points := append(pathSegment{}, s...)
+	for len(points) > 2 {
+		smallest, smallestArea := -1, math.Inf(1)
+		for i := 1; i < len(points)-1; i++ {
+			prev, p, next := points[i-1].lonLat, points[i].lonLat, points[i+1].lonLat
+			if proj.segmentDistance(p, prev, next) >= tolerance {
+				continue
+			}
+			if area := proj.triangleArea(prev, p, next); area < smallestArea {
+				smallest, smallestArea = i, area
+			}
+		}
+		if smallest < 0 {
+			break
+		}
+		points = append(points[:smallest], points[smallest+1:]...)
+	}
+	return points
+}
+
+func randomWalk(n int, seed int64) pathSegment {
+	r := rand.New(rand.NewSource(seed))
+	s := make(pathSegment, n)
+	p := lonLat{14, 50}
+	for i := range s {
+		p[0] += (r.Float64() - 0.5) * 0.001
+		p[1] += (r.Float64() - 0.5) * 0.001
+		s[i] = pathPoint{lonLat: p}
+	}
+	return s
+}
+
+func TestVisvalingamMatchesReference(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		s := randomWalk(200, seed)
+		for _, tolerance := range []float64{1, 10, 50} {
+			got, want := s.visvalingam(tolerance), visvalingamReference(s, tolerance)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("seed %d, tolerance %v: got %d points, want %d", seed, tolerance, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestVisvalingamLongTrack(t *testing.T) {
+	s := randomWalk(100000, 1)
+	start := time.Now()
+	out := s.visvalingam(20)
+	if len(out) < 2 || out[0] != s[0] || out[len(out)-1] != s[len(s)-1] {
+		t.Fatalf("the first and the last point have to be kept")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("100000 points took %s", elapsed)
+	}
+}
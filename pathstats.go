@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"github.com/twpayne/go-kml"
+	"math"
+	"strings"
+	"time"
+)
+
+var pathMovingSpeed = 0.3 // m/s; slower moves between two images do not count into the moving time
+
+var pathSummaries []string // statistics of the generated paths, printed at the end
+
+/*
+Statistics of a path (or its segment).
+ */
+type pathStats struct {
+	segments      int
+	distance      float64 // meters
+	elevationGain float64 // meters
+	hasElevation  bool
+	duration      time.Duration // from the first to the last time
+	movingTime    time.Duration // sum of the moves between the points
+	hasTime       bool
+	start, end    time.Time // the first and the last time
+}
+
+/*
+Returns statistics of the segment. The duration and the moving time are computed only from points with time,
+the elevation gain only from points with altitude.
+ */
+func (s pathSegment) stats() pathStats {
+	st := pathStats{segments: 1}
+	var first, last *pathPoint
+	for i := range s {
+		p := &s[i]
+		if i > 0 {
+			prev := &s[i-1]
+			d := distance(prev.lonLat, p.lonLat)
+			st.distance += d
+			if prev.hasAlt && p.hasAlt {
+				st.hasElevation = true
+				st.elevationGain += math.Max(0, p.alt-prev.alt)
+			}
+			if prev.hasTime && p.hasTime {
+				if dt := p.time.Sub(prev.time); dt > 0 && d/dt.Seconds() >= pathMovingSpeed {
+					st.movingTime += dt
+				}
+			}
+		}
+		if p.hasTime {
+			if first == nil {
+				first = p
+			}
+			last = p
+		}
+	}
+	if first != nil && last != first {
+		st.hasTime = true
+		st.start, st.end = first.time, last.time
+		st.duration = last.time.Sub(first.time)
+	}
+	return st
+}
+
+/*
+Adds the statistics of another segment. The duration spans from the first to the last time of both,
+including the time between them.
+ */
+func (st *pathStats) add(other pathStats) {
+	st.segments += other.segments
+	st.distance += other.distance
+	st.elevationGain += other.elevationGain
+	st.hasElevation = st.hasElevation || other.hasElevation
+	st.movingTime += other.movingTime
+	if other.hasTime {
+		if !st.hasTime || other.start.Before(st.start) {
+			st.start = other.start
+		}
+		if !st.hasTime || other.end.After(st.end) {
+			st.end = other.end
+		}
+		st.hasTime = true
+		st.duration = st.end.Sub(st.start)
+	}
+}
+
+/*
+Returns the average speed (in m/s) during the moving time, or 0 if it is unknown.
+ */
+func (st pathStats) averageSpeed() float64 {
+	if st.movingTime <= 0 {
+		return 0
+	}
+	return st.distance / st.movingTime.Seconds()
+}
+
+/*
+Returns the statistics as a list of "name: value" strings.
+ */
+func (st pathStats) lines() []string {
+	lines := []string{"Distance: " + formatDistance(st.distance)}
+	if st.segments > 1 {
+		lines = append(lines, fmt.Sprintf("Segments: %d", st.segments))
+	}
+	if st.hasElevation {
+		lines = append(lines, "Elevation gain: "+formatDistance(st.elevationGain))
+	}
+	if st.hasTime {
+		lines = append(lines, "Duration: "+formatDuration(st.duration), "Moving time: "+formatDuration(st.movingTime))
+		if speed := st.averageSpeed(); speed > 0 {
+			lines = append(lines, fmt.Sprintf("Average speed: %.1f km/h", speed*3.6))
+		}
+	}
+	return lines
+}
+
+func (st pathStats) String() string {
+	return strings.Join(st.lines(), ", ")
+}
+
+/*
+Returns the description and the ExtendedData of the path placemark with the total statistics,
+and the statistics of each segment (if there are more of them) in the description.
+ */
+func pathStatsElements(total pathStats, segments []pathStats) []kml.Element {
+	description := strings.Join(total.lines(), "<br/>")
+	if len(segments) > 1 {
+		for i, st := range segments {
+			description += fmt.Sprintf("<br/><br/><b>Segment %d</b><br/>%s", i+1, strings.Join(st.lines(), "<br/>"))
+		}
+	}
+
+	extData := kml.ExtendedData(
+		newData("distance", "Distance (m)", fmt.Sprintf("%.0f", total.distance)),
+	)
+	if total.hasElevation {
+		extData.Add(newData("elevationGain", "Elevation gain (m)", fmt.Sprintf("%.0f", total.elevationGain)))
+	}
+	if total.hasTime {
+		extData.Add(
+			newData("duration", "Duration (s)", fmt.Sprintf("%.0f", total.duration.Seconds())),
+			newData("movingTime", "Moving time (s)", fmt.Sprintf("%.0f", total.movingTime.Seconds())),
+			newData("averageSpeed", "Average speed (km/h)", fmt.Sprintf("%.1f", total.averageSpeed()*3.6)),
+		)
+	}
+	return []kml.Element{kml.Description(description), extData}
+}
+
+/*
+Returns the distance in m or km, e.g. "850 m" or "12.3 km".
+ */
+func formatDistance(meters float64) string {
+	if meters < 1000 {
+		return fmt.Sprintf("%.0f m", meters)
+	}
+	return fmt.Sprintf("%.1f km", meters/1000)
+}
+
+/*
+Returns the duration in days, hours and minutes, e.g. "1d 2h 05m" or "45m".
+ */
+func formatDuration(d time.Duration) string {
+	minutes := int(d.Round(time.Minute).Minutes())
+	days, hours := minutes/(24*60), minutes/60%24
+	minutes %= 60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %02dm", days, hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh %02dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
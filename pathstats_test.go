@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathStatsDurationSpansSegments(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	point := func(lon float64, minutes int) pathPoint {
+		return pathPoint{lonLat: lonLat{lon, 50}, time: t0.Add(time.Duration(minutes) * time.Minute), hasTime: true}
+	}
+	// two walks of 30 minutes with a 2 hour break between them
+	first := pathSegment{point(14, 0), point(14.01, 30)}.stats()
+	second := pathSegment{point(14.01, 150), point(14.02, 180)}.stats()
+
+	var total pathStats
+	total.add(first)
+	total.add(second)
+	if !total.hasTime || total.segments != 2 {
+		t.Fatalf("hasTime %v, %d segments", total.hasTime, total.segments)
+	}
+	if total.duration != 3*time.Hour {
+		t.Errorf("duration %v, want 3h", total.duration)
+	}
+	if total.movingTime != time.Hour {
+		t.Errorf("moving time %v, want 1h", total.movingTime)
+	}
+
+	// a segment without time does not change the duration
+	total.add(pathSegment{{lonLat: lonLat{15, 50}}, {lonLat: lonLat{15.01, 50}}}.stats())
+	if total.duration != 3*time.Hour {
+		t.Errorf("duration %v after a segment without time, want 3h", total.duration)
+	}
+}
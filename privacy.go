@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// privacy zones from the config file (set in parsePrivacyZones)
+var privacyZones []*privacyZone
+
+var privacyActions = []string{"drop", "centroid", "round"}
+
+const defaultPrivacyPrecision = 2
+
+/*
+An area where the exact location of images must not be published, either a circle or a polygon.
+Images inside the zone are dropped, moved to the centroid of the zone or their coordinates are rounded.
+ */
+type privacyZone struct {
+	name      string
+	center    lonLat  // center of the circle, or the centroid of the polygon
+	radius    float64 // radius of the circle in meters (0 for a polygon)
+	poly      polygon
+	action    string // one of privacyActions
+	precision int    // number of decimal places kept by the "round" action
+}
+
+/*
+Returns true if the point is inside the zone.
+ */
+func (z *privacyZone) contains(p lonLat) bool {
+	if z.poly != nil {
+		return z.poly.contains(p)
+	}
+	return distance(z.center, p) <= z.radius
+}
+
+/*
+Returns true if the line segment between a and b enters the zone.
+ */
+func (z *privacyZone) intersectsSegment(a, b lonLat) bool {
+	if z.contains(a) || z.contains(b) {
+		return true
+	}
+	if z.poly != nil {
+		for _, ring := range z.poly {
+			for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+				if segmentsIntersect(a, b, ring[j], ring[i]) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	// small circles only, so the equirectangular projection around the center is precise enough
+	project := func(p lonLat) (x, y float64) {
+		x = (p[0] - z.center[0]) * math.Pi / 180 * earthRadius * math.Cos(z.center[1]*math.Pi/180)
+		y = (p[1] - z.center[1]) * math.Pi / 180 * earthRadius
+		return
+	}
+	ax, ay := project(a)
+	bx, by := project(b)
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if lenSq := dx*dx + dy*dy; lenSq > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lenSq))
+	}
+	return math.Hypot(ax+t*dx, ay+t*dy) <= z.radius
+}
+
+/*
+Parses the "privacy" section of the config file: a list of zones, each with a "circle" (latitude, longitude
+and radius in meters), a "polygon" (list of [longitude, latitude]) or a GeoJSON "file" with polygons,
+and optionally "name", "action" (drop, centroid or round) and "precision" (decimal places for round).
+ */
+func parsePrivacyZones(val interface{}, ctx configContext) error {
+	list, ok := val.(dataArr)
+	if !ok {
+		return ctx.errorf("", "has to be a list of zones")
+	}
+	privacyZones = nil
+	for n, v := range list {
+		itemPath := fmt.Sprintf("[%d]", n)
+		obj, ok := v.(dataObj)
+		if !ok {
+			return ctx.errorf(itemPath, "zone has to be an object")
+		}
+		for _, key := range sortedKeys(obj) {
+			if !containsString([]string{"name", "circle", "polygon", "file", "action", "precision"}, key) {
+				return ctx.errorf(joinDataPath(itemPath, key), "unknown key %q", key)
+			}
+		}
+
+		zone := privacyZone{name: fmt.Sprintf("zone %d", n+1), action: "drop", precision: defaultPrivacyPrecision}
+		if name, ok := obj["name"]; ok {
+			zone.name = fmt.Sprint(name)
+		}
+		if action, ok := obj["action"]; ok {
+			zone.action = fmt.Sprint(action)
+			if !containsString(privacyActions, zone.action) {
+				return ctx.errorf(joinDataPath(itemPath, "action"), "action has to be one of: %s", strings.Join(privacyActions, ", "))
+			}
+		}
+		if precision, ok := obj["precision"]; ok {
+			p, err := getFloat64(precision)
+			if err != nil || p != math.Trunc(p) || p < 0 || p > 10 {
+				return ctx.errorf(joinDataPath(itemPath, "precision"), "precision has to be a whole number between 0 and 10")
+			}
+			zone.precision = int(p)
+		}
+
+		_, isCircle := obj["circle"]
+		_, isPolygon := obj["polygon"]
+		_, isFile := obj["file"]
+		if isCircle && (isPolygon || isFile) || isPolygon && isFile || !isCircle && !isPolygon && !isFile {
+			return ctx.errorf(itemPath, "zone needs exactly one of circle, polygon or file")
+		}
+
+		switch {
+		case isCircle:
+			circlePath := joinDataPath(itemPath, "circle")
+			circle, ok := obj["circle"].(dataObj)
+			if !ok {
+				return ctx.errorf(circlePath, "circle has to be an object with latitude, longitude and radius")
+			}
+			var vals [3]float64
+			for i, key := range []string{"latitude", "longitude", "radius"} {
+				f, err := getFloat64(circle[key])
+				if err != nil {
+					return ctx.errorf(joinDataPath(circlePath, key), "%s has to be a number", key)
+				}
+				vals[i] = f
+			}
+			if vals[0] < -90 || vals[0] > 90 || vals[1] < -180 || vals[1] > 180 || vals[2] <= 0 {
+				return ctx.errorf(circlePath, "invalid circle (latitude -90..90, longitude -180..180, radius > 0)")
+			}
+			zone.center = lonLat{vals[1], vals[0]}
+			zone.radius = vals[2]
+			privacyZones = append(privacyZones, &zone)
+
+		case isPolygon:
+			polygonPath := joinDataPath(itemPath, "polygon")
+			points, ok := obj["polygon"].(dataArr)
+			if !ok || len(points) < 3 {
+				return ctx.errorf(polygonPath, "polygon has to be a list of at least 3 points [longitude, latitude]")
+			}
+			ring := make([]lonLat, len(points))
+			for i, point := range points {
+				coords, ok := point.(dataArr)
+				if !ok || len(coords) != 2 {
+					return ctx.errorf(fmt.Sprintf("%s[%d]", polygonPath, i), "point has to be [longitude, latitude]")
+				}
+				for j := range coords {
+					f, err := getFloat64(coords[j])
+					if err != nil {
+						return ctx.errorf(fmt.Sprintf("%s[%d]", polygonPath, i), "point has to be [longitude, latitude]")
+					}
+					ring[i][j] = f
+				}
+			}
+			zone.poly = polygon{ring}
+			zone.center = zone.poly.centroid()
+			privacyZones = append(privacyZones, &zone)
+
+		default:
+			polygons, err := loadGeoJsonPolygons(ctx.resolvePath(fmt.Sprint(obj["file"])))
+			if err != nil {
+				return ctx.errorf(joinDataPath(itemPath, "file"), "%s", err)
+			}
+			for _, poly := range polygons {
+				polyZone := zone
+				polyZone.poly = poly
+				polyZone.center = poly.centroid()
+				privacyZones = append(privacyZones, &polyZone)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Returns the first privacy zone containing the point, or nil.
+ */
+func findPrivacyZone(p lonLat) *privacyZone {
+	for _, zone := range privacyZones {
+		if zone.contains(p) {
+			return zone
+		}
+	}
+	return nil
+}
+
+/*
+Applies the privacy zones to the located images: sets their privacyZone and moves them to the centroid
+of the zone or rounds their coordinates. The dropped images are filtered out later (see filterReason).
+It has to be called before anything is output.
+ */
+func applyPrivacyZones(images []*imagePlacemark) {
+	for _, img := range images {
+		if !img.hasLocation {
+			continue
+		}
+		img.privacyZone = findPrivacyZone(lonLat{img.longitude, img.latitude})
+		if img.privacyZone == nil {
+			continue
+		}
+		switch img.privacyZone.action {
+		case "centroid":
+			img.longitude, img.latitude = img.privacyZone.center[0], img.privacyZone.center[1]
+		case "round":
+			scale := math.Pow(10, float64(img.privacyZone.precision))
+			img.longitude = math.Round(img.longitude*scale) / scale
+			img.latitude = math.Round(img.latitude*scale) / scale
+		}
+	}
+}
+
+/*
+Returns true if the line segment between a and b enters any privacy zone.
+ */
+func segmentEntersPrivacyZone(a, b lonLat) bool {
+	for _, zone := range privacyZones {
+		if zone.intersectsSegment(a, b) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var progressModes = []string{"auto", "bar", "log", "json", "none"}
+
+var progressBarInterval = 100 * time.Millisecond // how often the bar is redrawn
+var progressLogInterval = 10 * time.Second       // how often a log line is written
+var progressEventInterval = time.Second          // how often a JSON event is written
+var progressBarWidth = 30
+
+var progressOutput string // bar, log, json or none (set in setupProgress)
+
+var currentBar *progress // the progress shown as the bar (nil if there is none)
+var progressMu sync.Mutex
+
+/*
+Progress of a phase of the build (indexing, resizing, ...).
+ */
+type progress struct {
+	phase     string // identifier used in the events, e.g. "resize"
+	label     string // e.g. "Preparing images"
+	unit      string // e.g. "images"
+	total     int    // 0 if unknown
+	done      int
+	start     time.Time
+	lastShown time.Time
+}
+
+/*
+A JSON progress event (-progress json).
+ */
+type progressEvent struct {
+	Event   string  `json:"event"` // start, progress or end
+	Phase   string  `json:"phase"` // index, resize, kml or write
+	Done    int     `json:"done"`
+	Total   int     `json:"total,omitempty"` // 0 if unknown
+	Rate    float64 `json:"rate"`            // units per second
+	Eta     float64 `json:"eta,omitempty"`   // seconds
+	Elapsed float64 `json:"elapsed"`         // seconds
+}
+
+/*
+Checks -progress and resolves auto: a bar if the log is written as text to a terminal, log lines otherwise.
+ */
+func setupProgress() error {
+	if !containsString(progressModes, progressMode) {
+		return fmt.Errorf("-progress has to be one of: %s", strings.Join(progressModes, ", "))
+	}
+	progressOutput = progressMode
+	if progressMode == "auto" {
+		progressOutput = "log"
+		if logFormat == "text" && isTerminal(os.Stderr) {
+			progressOutput = "bar"
+		}
+	}
+	if quiet && (progressOutput == "bar" || progressOutput == "log") {
+		progressOutput = "none"
+	}
+	return nil
+}
+
+/*
+Returns true if the file is a terminal (character device).
+ */
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+/*
+Starts the progress of a phase with the total count of units (0 if unknown).
+ */
+func startProgress(phase, label, unit string, total int) *progress {
+	p := &progress{phase: phase, label: label, unit: unit, total: total, start: time.Now()}
+	p.lastShown = p.start
+	switch progressOutput {
+	case "bar":
+		progressMu.Lock()
+		currentBar = p
+		p.drawBar()
+		progressMu.Unlock()
+	case "json":
+		p.writeEvent("start")
+	default:
+		slog.Info(label + "...")
+	}
+	return p
+}
+
+/*
+Adds the count of finished units and shows the progress if it has not been shown for a while.
+ */
+func (p *progress) add(n int) {
+	p.done += n
+	now := time.Now()
+	switch progressOutput {
+	case "bar":
+		if now.Sub(p.lastShown) >= progressBarInterval {
+			progressMu.Lock()
+			p.drawBar()
+			progressMu.Unlock()
+			p.lastShown = now
+		}
+	case "log":
+		if now.Sub(p.lastShown) >= progressLogInterval {
+			slog.Info(p.label+": "+p.status(), "phase", p.phase, "done", p.done, "total", p.total)
+			p.lastShown = now
+		}
+	case "json":
+		if now.Sub(p.lastShown) >= progressEventInterval {
+			p.writeEvent("progress")
+			p.lastShown = now
+		}
+	}
+}
+
+/*
+Ends the progress of the phase.
+ */
+func (p *progress) finish() {
+	elapsed := time.Since(p.start)
+	summary := fmt.Sprintf("%s: %d %s in %s", p.label, p.done, p.unit, formatEta(elapsed))
+	if rate := p.rate(); rate > 0 {
+		summary += fmt.Sprintf(" (%.1f/s)", rate)
+	}
+	switch progressOutput {
+	case "bar":
+		progressMu.Lock()
+		currentBar = nil
+		fmt.Fprint(os.Stderr, "\r\033[K"+summary+"\n")
+		progressMu.Unlock()
+	case "log":
+		if elapsed >= progressLogInterval { // short phases are not worth a line
+			slog.Info(summary)
+		}
+	case "json":
+		p.writeEvent("end")
+	}
+}
+
+/*
+Returns the number of units per second.
+ */
+func (p *progress) rate() float64 {
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.done) / elapsed
+}
+
+/*
+Returns the estimated remaining time, or false if it is unknown.
+ */
+func (p *progress) eta() (time.Duration, bool) {
+	rate := p.rate()
+	if p.total <= 0 || p.done == 0 || rate <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(p.total-p.done) / rate * float64(time.Second)), true
+}
+
+/*
+Returns the progress as a text, e.g. "120/2000 images (6%), 2.1/s, ETA 15m".
+ */
+func (p *progress) status() string {
+	var s string
+	if p.total > 0 {
+		s = fmt.Sprintf("%d/%d %s (%d%%)", p.done, p.total, p.unit, p.done*100/p.total)
+	} else {
+		s = fmt.Sprintf("%d %s", p.done, p.unit)
+	}
+	if rate := p.rate(); rate > 0 {
+		s += fmt.Sprintf(", %.1f/s", rate)
+	}
+	if eta, ok := p.eta(); ok {
+		s += ", ETA " + formatEta(eta)
+	}
+	return s
+}
+
+/*
+Draws the progress bar over the current line of the standard error output. progressMu has to be locked.
+ */
+func (p *progress) drawBar() {
+	bar := ""
+	if p.total > 0 {
+		filled := minInt(progressBarWidth, p.done*progressBarWidth/p.total)
+		bar = "[" + strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled) + "] "
+	}
+	fmt.Fprint(os.Stderr, "\r\033[K"+p.label+" "+bar+p.status())
+}
+
+/*
+Writes the JSON event to the standard output.
+ */
+func (p *progress) writeEvent(event string) {
+	round := func(x float64) float64 {
+		return math.Round(x*1000) / 1000
+	}
+	e := progressEvent{Event: event, Phase: p.phase, Done: p.done, Total: p.total, Rate: round(p.rate()),
+		Elapsed: round(time.Since(p.start).Seconds())}
+	if eta, ok := p.eta(); ok && event == "progress" {
+		e.Eta = round(eta.Seconds())
+	}
+	line, _ := json.Marshal(e)
+	fmt.Println(string(line))
+}
+
+/*
+Clears the progress bar (if it is shown), so that a log line can be written, and returns a function that draws it
+again.
+ */
+func clearProgressBar() (redraw func()) {
+	progressMu.Lock()
+	if currentBar == nil {
+		progressMu.Unlock()
+		return func() {}
+	}
+	fmt.Fprint(os.Stderr, "\r\033[K")
+	return func() {
+		currentBar.drawBar()
+		progressMu.Unlock()
+	}
+}
+
+/*
+Returns the duration for the progress, e.g. "45s" or "1h 05m".
+ */
+func formatEta(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(d.Round(time.Second).Seconds()))
+	}
+	return formatDuration(d)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+	"io"
+	"math"
+)
+
+/*
+A progressive JPEG encoder (-progressive); image/jpeg writes only baseline JPEGs. The image is encoded in YCbCr
+with 4:2:0 chroma subsampling, the standard quantization tables scaled by the quality (as image/jpeg does)
+and the standard Huffman tables. The scans use spectral selection only (no successive approximation):
+the DC coefficients of all components first, then a few low frequencies of the luminance, the chrominance,
+and the rest of the luminance. So a browser shows a blurry image first and sharpens it as the scans load.
+ */
+
+// the standard quantization tables (ITU T.81, K.1), in the natural order
+var jpegQuantTables = [2][64]int{
+	{ // luminance
+		16, 11, 10, 16, 24, 40, 51, 61,
+		12, 12, 14, 19, 26, 58, 60, 55,
+		14, 13, 16, 24, 40, 57, 69, 56,
+		14, 17, 22, 29, 51, 87, 80, 62,
+		18, 22, 37, 56, 68, 109, 103, 77,
+		24, 35, 55, 64, 81, 104, 113, 92,
+		49, 64, 78, 87, 103, 121, 120, 101,
+		72, 92, 95, 98, 112, 100, 103, 99,
+	},
+	{ // chrominance
+		17, 18, 24, 47, 99, 99, 99, 99,
+		18, 21, 26, 66, 99, 99, 99, 99,
+		24, 26, 56, 99, 99, 99, 99, 99,
+		47, 66, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+/*
+A Huffman table: the number of codes of each length (1-16 bits) and the symbols in the order of their codes.
+ */
+type huffmanTable struct {
+	counts  [16]byte
+	symbols []byte
+}
+
+// the standard Huffman tables (ITU T.81, K.3): luminance DC, luminance AC, chrominance DC, chrominance AC
+var jpegHuffmanTables = [4]huffmanTable{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+/*
+A scan of the progressive JPEG: the components (0 = Y, 1 = Cb, 2 = Cr) and the band of coefficients
+(in the zig-zag order).
+ */
+type jpegScan struct {
+	components []int
+	start, end int
+}
+
+var progressiveScans = []jpegScan{
+	{[]int{0, 1, 2}, 0, 0},
+	{[]int{0}, 1, 5},
+	{[]int{1}, 1, 63},
+	{[]int{2}, 1, 63},
+	{[]int{0}, 6, 63},
+}
+
+var zigzag = zigzagOrder() // natural index of the n-th coefficient in the zig-zag order
+var dctCos = dctCosTable() // dctCos[u][x] = C(u)/2 * cos((2x+1)uπ/16)
+var huffmanCodes = func() (codes [4][256]huffmanCode) {
+	for i, table := range jpegHuffmanTables {
+		code, k := uint32(0), 0
+		for length, count := range table.counts {
+			for j := 0; j < int(count); j++ {
+				codes[i][table.symbols[k]] = huffmanCode{code, uint(length + 1)}
+				code++
+				k++
+			}
+			code <<= 1
+		}
+	}
+	return codes
+}()
+
+/*
+A Huffman code of a symbol.
+ */
+type huffmanCode struct {
+	code uint32
+	bits uint
+}
+
+/*
+Returns the natural indexes of the coefficients of a block in the zig-zag order.
+ */
+func zigzagOrder() (order [64]int) {
+	x, y := 0, 0
+	for n := range order {
+		order[n] = y*8 + x
+		if (x+y)%2 == 0 { // going up and right
+			if x == 7 {
+				y++
+			} else if y == 0 {
+				x++
+			} else {
+				x, y = x+1, y-1
+			}
+		} else { // going down and left
+			if y == 7 {
+				x++
+			} else if x == 0 {
+				y++
+			} else {
+				x, y = x-1, y+1
+			}
+		}
+	}
+	return order
+}
+
+func dctCosTable() (table [8][8]float64) {
+	for u := 0; u < 8; u++ {
+		c := 0.5
+		if u == 0 {
+			c = 0.5 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			table[u][x] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return table
+}
+
+/*
+Returns the quantization tables scaled by the quality (1-100) in the same way as image/jpeg, in the zig-zag order.
+ */
+func scaledQuantTables(quality int) (tables [2][64]int) {
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	for i := range tables {
+		for n, index := range zigzag {
+			q := (jpegQuantTables[i][index]*scale + 50) / 100
+			if q < 1 {
+				q = 1
+			} else if q > 255 {
+				q = 255
+			}
+			tables[i][n] = q
+		}
+	}
+	return tables
+}
+
+/*
+The quantized coefficients (in the zig-zag order) of the blocks of a component, row by row.
+ */
+type jpegComponent struct {
+	blocks                  [][64]int
+	blocksPerRow, blockRows int // of the MCU-aligned grid
+	scanBlocks, scanRows    int // blocks covering the component (used in the scans of only this component)
+	sampling                int // blocks per MCU in each direction
+	quant, dcTable, acTable int
+}
+
+/*
+Writes the image as a progressive JPEG with the quality (1-100). Transparency is ignored.
+ */
+func encodeProgressiveJpeg(w io.Writer, img image.Image, quality int) error {
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok || nrgba.Rect.Min != (image.Point{}) {
+		nrgba = imaging.Clone(img)
+	}
+	width, height := nrgba.Rect.Dx(), nrgba.Rect.Dy()
+	if width < 1 || height < 1 || width > 65535 || height > 65535 {
+		return fmt.Errorf("the image is too large (or empty) for a JPEG: %dx%d", width, height)
+	}
+
+	quant := scaledQuantTables(quality)
+	mcuCols, mcuRows := (width+15)/16, (height+15)/16
+	components := [3]*jpegComponent{
+		{sampling: 2, quant: 0, dcTable: 0, acTable: 1, scanBlocks: (width + 7) / 8, scanRows: (height + 7) / 8},
+		{sampling: 1, quant: 1, dcTable: 2, acTable: 3, scanBlocks: (width + 15) / 16, scanRows: (height + 15) / 16},
+		{sampling: 1, quant: 1, dcTable: 2, acTable: 3, scanBlocks: (width + 15) / 16, scanRows: (height + 15) / 16},
+	}
+	for _, c := range components {
+		c.blocksPerRow, c.blockRows = mcuCols*c.sampling, mcuRows*c.sampling
+		c.blocks = make([][64]int, c.blocksPerRow*c.blockRows)
+	}
+
+	// converts the pixels (the edges are repeated to fill the MCUs) and transforms the blocks
+	ycbcr := func(x, y int) (float64, float64, float64) {
+		if x >= width {
+			x = width - 1
+		}
+		if y >= height {
+			y = height - 1
+		}
+		p := nrgba.Pix[y*nrgba.Stride+x*4:]
+		r, g, b := float64(p[0]), float64(p[1]), float64(p[2])
+		return 0.299*r + 0.587*g + 0.114*b, -0.168736*r - 0.331264*g + 0.5*b, 0.5*r - 0.418688*g - 0.081312*b
+	}
+	var samples [3][64]float64
+	for by := 0; by < mcuRows*2; by++ {
+		for bx := 0; bx < mcuCols*2; bx++ {
+			for i := 0; i < 64; i++ {
+				samples[0][i], _, _ = ycbcr(bx*8+i%8, by*8+i/8)
+				samples[0][i] -= 128
+			}
+			fdctQuantize(&samples[0], &quant[0], &components[0].blocks[by*components[0].blocksPerRow+bx])
+		}
+	}
+	for by := 0; by < mcuRows; by++ {
+		for bx := 0; bx < mcuCols; bx++ {
+			for i := 0; i < 64; i++ {
+				var cb, cr float64
+				for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} { // averages 2x2 pixels
+					_, b, r := ycbcr(bx*16+i%8*2+d[0], by*16+i/8*2+d[1])
+					cb, cr = cb+b/4, cr+r/4
+				}
+				samples[1][i], samples[2][i] = cb, cr
+			}
+			fdctQuantize(&samples[1], &quant[1], &components[1].blocks[by*mcuCols+bx])
+			fdctQuantize(&samples[2], &quant[1], &components[2].blocks[by*mcuCols+bx])
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte{0xff, 0xd8}) // SOI
+	dqt := []byte{}
+	for i, table := range quant {
+		dqt = append(dqt, byte(i))
+		for _, q := range table {
+			dqt = append(dqt, byte(q))
+		}
+	}
+	bw.Write(jpegSegment(0xdb, dqt))
+	sof := []byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), 3}
+	for i, c := range components {
+		sof = append(sof, byte(i+1), byte(c.sampling<<4|c.sampling), byte(c.quant))
+	}
+	bw.Write(jpegSegment(0xc2, sof)) // SOF2: progressive DCT
+	dht := []byte{}
+	for i, table := range jpegHuffmanTables {
+		dht = append(dht, byte(i%2<<4|i/2)) // class (DC 0, AC 1) and id (luminance 0, chrominance 1)
+		dht = append(dht, table.counts[:]...)
+		dht = append(dht, table.symbols...)
+	}
+	bw.Write(jpegSegment(0xc4, dht))
+
+	for _, scan := range progressiveScans {
+		sos := []byte{byte(len(scan.components))}
+		for _, i := range scan.components {
+			sos = append(sos, byte(i+1), byte(components[i].dcTable/2<<4|components[i].acTable/2))
+		}
+		sos = append(sos, byte(scan.start), byte(scan.end), 0)
+		bw.Write(jpegSegment(0xda, sos))
+		bits := &jpegBitWriter{w: bw}
+		if scan.start == 0 {
+			writeDcScan(bits, components[:], mcuCols, mcuRows)
+		} else {
+			c := components[scan.components[0]]
+			for by := 0; by < c.scanRows; by++ {
+				for bx := 0; bx < c.scanBlocks; bx++ {
+					writeAcBand(bits, &c.blocks[by*c.blocksPerRow+bx], scan.start, scan.end, c.acTable)
+				}
+			}
+		}
+		bits.flush()
+	}
+	bw.Write([]byte{0xff, 0xd9}) // EOI
+	return bw.Flush()
+}
+
+/*
+Transforms the level-shifted samples of a block by the forward DCT and writes the quantized coefficients
+in the zig-zag order.
+ */
+func fdctQuantize(samples *[64]float64, quant *[64]int, coefs *[64]int) {
+	var rows [64]float64 // the rows transformed
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < 8; x++ {
+				sum += dctCos[u][x] * samples[y*8+x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+	for n, index := range zigzag {
+		u, v := index%8, index/8
+		sum := 0.0
+		for y := 0; y < 8; y++ {
+			sum += dctCos[v][y] * rows[y*8+u]
+		}
+		c := int(math.Round(sum / float64(quant[n])))
+		if c > 1023 { // the largest value of a baseline AC coefficient, more precision is not useful
+			c = 1023
+		} else if c < -1023 {
+			c = -1023
+		}
+		coefs[n] = c
+	}
+}
+
+/*
+Writes the DC coefficients of all the components, MCU by MCU.
+ */
+func writeDcScan(bits *jpegBitWriter, components []*jpegComponent, mcuCols, mcuRows int) {
+	var pred [3]int
+	for my := 0; my < mcuRows; my++ {
+		for mx := 0; mx < mcuCols; mx++ {
+			for i, c := range components {
+				for v := 0; v < c.sampling; v++ {
+					for h := 0; h < c.sampling; h++ {
+						dc := c.blocks[(my*c.sampling+v)*c.blocksPerRow+mx*c.sampling+h][0]
+						size, value := jpegMagnitude(dc - pred[i])
+						bits.writeCode(c.dcTable, byte(size))
+						bits.write(value, size)
+						pred[i] = dc
+					}
+				}
+			}
+		}
+	}
+}
+
+/*
+Writes the AC coefficients of the block between start and end (in the zig-zag order). The end of the band
+is written as EOB (not as an EOB run, so that the standard tables can be used).
+ */
+func writeAcBand(bits *jpegBitWriter, coefs *[64]int, start, end, table int) {
+	run := 0
+	for n := start; n <= end; n++ {
+		if coefs[n] == 0 {
+			run++
+			continue
+		}
+		for ; run > 15; run -= 16 {
+			bits.writeCode(table, 0xf0) // ZRL
+		}
+		size, value := jpegMagnitude(coefs[n])
+		bits.writeCode(table, byte(run<<4|int(size)))
+		bits.write(value, size)
+		run = 0
+	}
+	if run > 0 {
+		bits.writeCode(table, 0x00) // EOB
+	}
+}
+
+/*
+Returns the number of bits of the magnitude of the value and its bits as they are written
+(negative values as the one's complement).
+ */
+func jpegMagnitude(value int) (size uint, bits uint32) {
+	abs := value
+	if value < 0 {
+		abs, value = -value, value-1
+	}
+	for abs > 0 {
+		size++
+		abs >>= 1
+	}
+	return size, uint32(value) & (1<<size - 1)
+}
+
+/*
+Writes the entropy-coded data of a scan, with 0xff bytes stuffed.
+ */
+type jpegBitWriter struct {
+	w     *bufio.Writer
+	acc   uint32
+	nBits uint
+}
+
+func (b *jpegBitWriter) write(bits uint32, n uint) {
+	for ; n > 0; n-- {
+		b.acc = b.acc<<1 | bits>>(n-1)&1
+		b.nBits++
+		if b.nBits == 8 {
+			b.w.WriteByte(byte(b.acc))
+			if b.acc == 0xff {
+				b.w.WriteByte(0)
+			}
+			b.acc, b.nBits = 0, 0
+		}
+	}
+}
+
+func (b *jpegBitWriter) writeCode(table int, symbol byte) {
+	code := huffmanCodes[table][symbol]
+	b.write(code.code, code.bits)
+}
+
+/*
+Pads the last byte with 1 bits.
+ */
+func (b *jpegBitWriter) flush() {
+	if b.nBits > 0 {
+		b.write(1<<(8-b.nBits)-1, 8-b.nBits)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+/*
+Returns an image with gradients and a sharp edge.
+ */
+func progressiveTestImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255}
+			if x > width/2 && y > height/2 {
+				c.B = 240
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+/*
+Returns the mean squared error of the RGB channels.
+ */
+func meanSquaredError(a, b image.Image) float64 {
+	sum, n := 0.0, 0
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			for _, d := range []float64{float64(r1>>8) - float64(r2>>8), float64(g1>>8) - float64(g2>>8), float64(b1>>8) - float64(b2>>8)} {
+				sum += d * d
+				n++
+			}
+		}
+	}
+	return sum / float64(n)
+}
+
+func TestEncodeProgressiveJpeg(t *testing.T) {
+	for _, size := range [][2]int{{1, 1}, {16, 16}, {37, 23}, {200, 150}} {
+		img := progressiveTestImage(size[0], size[1])
+		var buf bytes.Buffer
+		if err := encodeProgressiveJpeg(&buf, img, 90); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(buf.Bytes(), []byte{0xff, 0xc2}) {
+			t.Errorf("%dx%d: no SOF2 marker", size[0], size[1])
+		}
+		decoded, err := jpeg.Decode(&buf)
+		if err != nil {
+			t.Fatalf("%dx%d: %v", size[0], size[1], err)
+		}
+		if decoded.Bounds().Dx() != size[0] || decoded.Bounds().Dy() != size[1] {
+			t.Fatalf("%dx%d: decoded as %v", size[0], size[1], decoded.Bounds())
+		}
+
+		var baseline bytes.Buffer
+		if err := jpeg.Encode(&baseline, img, &jpeg.Options{Quality: 90}); err != nil {
+			t.Fatal(err)
+		}
+		decodedBaseline, _ := jpeg.Decode(&baseline)
+		mse, mseBaseline := meanSquaredError(img, decoded), meanSquaredError(img, decodedBaseline)
+		if mse > math.Max(2*mseBaseline, 4) {
+			t.Errorf("%dx%d: error %.1f, baseline %.1f", size[0], size[1], mse, mseBaseline)
+		}
+	}
+}
+
+func TestJpegMagnitude(t *testing.T) {
+	tests := []struct {
+		value int
+		size  uint
+		bits  uint32
+	}{{0, 0, 0}, {1, 1, 1}, {-1, 1, 0}, {5, 3, 5}, {-5, 3, 2}, {1023, 10, 1023}, {-1023, 10, 0}}
+	for _, test := range tests {
+		if size, bits := jpegMagnitude(test.value); size != test.size || bits != test.bits {
+			t.Errorf("%d: %d bits %b, want %d bits %b", test.value, size, bits, test.size, test.bits)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	filepath2 "path/filepath"
+	"sort"
+)
+
+var report *buildReport // written to -report and to the manifest
+
+/*
+The JSON report of a build (-report).
+ */
+type buildReport struct {
+	DryRun   bool          `json:"dryRun"`
+	Kml      string        `json:"kml,omitempty"` // the output document (empty in a dry run)
+	Kmz      string        `json:"kmz,omitempty"`
+	Warnings []string      `json:"warnings"` // warnings not related to a single image (e.g. data file problems)
+	Images   []imageReport `json:"images"`
+	Totals   reportTotals  `json:"totals"`
+}
+
+/*
+An input image in the report.
+ */
+type imageReport struct {
+	File          string   `json:"file"`             // path relative to the source directory, or the external URL
+	Source        string   `json:"source,omitempty"` // label of the source, if there are more sources
+	Status        string   `json:"status"`           // placed, skipped-no-location, filtered or failed-decode
+	Reason        string   `json:"reason,omitempty"` // why the image is filtered out
+	CollapsedInto string   `json:"collapsedInto,omitempty"` // the image whose placemark contains this one (-duplicates collapse)
+	Image         string   `json:"image,omitempty"`  // path of the image in the KML (relative to the output directory)
+	Icon          string   `json:"icon,omitempty"`   // ~ of the icon
+	Warnings      []string `json:"warnings"`
+	Errors        []string `json:"errors"` // errors of the image (they make the build fail with -strict)
+}
+
+type reportTotals struct {
+	Images            int `json:"images"`
+	Placed            int `json:"placed"`
+	SkippedNoLocation int `json:"skippedNoLocation"`
+	Filtered          int `json:"filtered"`
+	FailedDecode      int `json:"failedDecode"`
+	Warnings          int `json:"warnings"`
+	Errors            int `json:"errors"`
+}
+
+/*
+Starts collecting the report.
+ */
+func setupReport() {
+	if reportFilepath != "" {
+		reportFilepath = normalizePath(reportFilepath)
+	}
+	report = &buildReport{DryRun: dryRun, Warnings: []string{}, Images: []imageReport{}}
+}
+
+/*
+Adds the image with the status to the report. The output paths are added only to placed images, so this has to
+be called before they are replaced by base64 data.
+ */
+func reportImage(img *imagePlacemark, status string) {
+	if report == nil {
+		return
+	}
+	entry := imageReport{Status: status, Reason: img.filtered, Warnings: img.warnings, Errors: img.errors}
+	if entry.Warnings == nil {
+		entry.Warnings = []string{}
+	}
+	if entry.Errors == nil {
+		entry.Errors = []string{}
+	}
+	if img.source != nil {
+		entry.File = img.origPath
+		if len(sources) > 1 {
+			entry.Source = img.source.label
+		}
+	} else {
+		entry.File = img.externalPath
+	}
+	if status == "placed" {
+		entry.Image, entry.Icon = img.pathInKml, img.iconPathInKml
+	}
+	report.Images = append(report.Images, entry)
+
+	for _, dup := range img.duplicates {
+		reportImage(dup, status)
+		report.Images[len(report.Images)-1].CollapsedInto = img.displayName()
+		report.Images[len(report.Images)-1].Icon = ""
+	}
+}
+
+/*
+Sorts the images of the report by source and file and computes the totals.
+ */
+func finishReport() {
+	sort.SliceStable(report.Images, func(i, j int) bool {
+		a, b := report.Images[i], report.Images[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.File < b.File
+	})
+
+	t := reportTotals{Images: len(report.Images), Warnings: len(report.Warnings)}
+	for _, img := range report.Images {
+		switch img.Status {
+		case "placed":
+			t.Placed++
+		case "skipped-no-location":
+			t.SkippedNoLocation++
+		case "filtered":
+			t.Filtered++
+		case "failed-decode":
+			t.FailedDecode++
+		}
+		t.Warnings += len(img.Warnings)
+		t.Errors += len(img.Errors)
+	}
+	report.Totals = t
+}
+
+/*
+Writes the report as JSON if -report is set.
+ */
+func writeReport() error {
+	if reportFilepath == "" {
+		return nil
+	}
+	finishReport()
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := createDir(filepath2.Dir(reportFilepath)); err != nil {
+		return outputError(err)
+	}
+	return outputError(ioutil.WriteFile(reportFilepath, append(content, '\n'), 0644))
+}
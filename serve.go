@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	filepath2 "path/filepath"
+	"strings"
+)
+
+// MIME types of the served files that are not (reliably) known to the system
+var serveMimeTypes = map[string]string{
+	".kml":  "application/vnd.google-earth.kml+xml",
+	".kmz":  "application/vnd.google-earth.kmz",
+	".json": "application/json",
+	".gpx":  "application/gpx+xml",
+}
+
+/*
+Runs the HTTP server of the serve command over the output directory until it fails.
+ */
+func runServer() {
+	dir := normalizePath(outDir)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		fatal(exitInput, "The output directory does not exist: "+dir)
+	}
+	slog.Info(fmt.Sprintf("Serving %s at http://%s/ (press Ctrl+C to stop)", dir, serveAddr))
+	fatalIfErr(http.ListenAndServe(serveAddr, newServeHandler(dir)), exitFailure)
+}
+
+/*
+Returns the handler of the serve command: the index page with the build stats at /, the viewer at /viewer
+and the files of the directory. Everything is served from the directory and the binary (nothing from
+the internet), so it works offline; it uses no global state, so it can be tested with httptest.
+Paths with .. are not found (instead of being redirected to the cleaned path).
+ */
+func newServeHandler(dir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/viewer", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, viewerHtml)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			serveIndex(w, dir)
+		} else {
+			serveOutputFile(w, r, dir)
+		}
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range strings.Split(r.URL.Path, "/") {
+			if part == ".." {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+/*
+Serves a file of the directory with its MIME type. Directories are not listed.
+ */
+func serveOutputFile(w http.ResponseWriter, r *http.Request, dir string) {
+	urlPath := path.Clean("/" + r.URL.Path)
+	file := filepath2.Join(dir, filepath2.FromSlash(urlPath))
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	ext := strings.ToLower(path.Ext(urlPath))
+	if mimeType, ok := serveMimeTypes[ext]; ok {
+		w.Header().Set("Content-Type", mimeType)
+	} else if mimeType, err := getImageMimeType(strings.TrimPrefix(ext, ".")); err == nil {
+		w.Header().Set("Content-Type", mimeType)
+	}
+	http.ServeFile(w, r, file)
+}
+
+/*
+Data of the index page.
+ */
+type serveIndexData struct {
+	Dir         string
+	Manifest    *buildManifest // nil if the directory has no manifest
+	Error       string         // why the manifest cannot be read
+	Images      []imageReport  // images with warnings or errors
+	HasKml      bool
+	HasKmz      bool
+	NetworkLink bool
+}
+
+/*
+Writes the index page: links to the documents and the viewer, and the report of the build from the manifest.
+ */
+func serveIndex(w http.ResponseWriter, dir string) {
+	data := serveIndexData{Dir: dir}
+	exists := func(name string) bool {
+		_, err := os.Stat(joinPaths(dir, name))
+		return err == nil
+	}
+	data.HasKml, data.HasKmz, data.NetworkLink = exists("doc.kml"), exists("doc.kmz"), exists(networkLinkFilename)
+
+	content, err := ioutil.ReadFile(joinPaths(dir, manifestFilename))
+	if err == nil {
+		m := &buildManifest{}
+		if err = json.Unmarshal(content, m); err == nil {
+			data.Manifest = m
+		}
+	}
+	if err != nil {
+		data.Error = err.Error()
+	} else if data.Manifest.Report != nil {
+		for _, img := range data.Manifest.Report.Images {
+			if len(img.Warnings) > 0 || len(img.Errors) > 0 {
+				data.Images = append(data.Images, img)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := serveIndexTemplate.Execute(w, data); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+var serveIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>{{with .Manifest}}{{if .Name}}{{.Name}} - {{end}}{{end}}photo-map</title>
+	<style>
+		body {font-family: sans-serif; margin: 2em; max-width: 60em;}
+		table {border-collapse: collapse;}
+		td, th {border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; vertical-align: top;}
+		.error {color: #b00;}
+		.warning {color: #a60;}
+	</style>
+</head>
+<body>
+	<h1>{{with .Manifest}}{{if .Name}}{{.Name}}{{else}}photo-map{{end}}{{else}}photo-map{{end}}</h1>
+	<p>{{.Dir}}</p>
+	<ul>
+		{{if .HasKml}}<li><a href="/viewer">Viewer</a></li>
+		<li><a href="/doc.kml">doc.kml</a></li>{{else}}<li class="error">There is no doc.kml</li>{{end}}
+		{{if .HasKmz}}<li><a href="/doc.kmz">doc.kmz</a></li>{{end}}
+		{{if .NetworkLink}}<li><a href="/network-link.kml">network-link.kml</a></li>{{end}}
+	</ul>
+	{{with .Manifest}}
+	<h2>Build</h2>
+	<p>Built {{.Built}}</p>
+	{{with .Report}}
+	<table>
+		<tr><th>Images</th><td>{{.Totals.Images}}</td></tr>
+		<tr><th>Placed</th><td>{{.Totals.Placed}}</td></tr>
+		<tr><th>Without location</th><td>{{.Totals.SkippedNoLocation}}</td></tr>
+		<tr><th>Filtered out</th><td>{{.Totals.Filtered}}</td></tr>
+		<tr><th>Failed to decode</th><td>{{.Totals.FailedDecode}}</td></tr>
+		<tr><th>Warnings</th><td>{{.Totals.Warnings}}</td></tr>
+		<tr><th>Errors</th><td>{{.Totals.Errors}}</td></tr>
+	</table>
+	{{if .Warnings}}
+	<h2>Warnings</h2>
+	<ul>{{range .Warnings}}<li class="warning">{{.}}</li>{{end}}</ul>
+	{{end}}
+	{{end}}
+	{{end}}
+	{{if .Images}}
+	<h2>Images with problems</h2>
+	<table>
+		<tr><th>Image</th><th>Status</th><th>Problems</th></tr>
+		{{range .Images}}
+		<tr>
+			<td>{{if .Source}}{{.Source}}: {{end}}{{if .Image}}<a href="{{.Image}}">{{.File}}</a>{{else}}{{.File}}{{end}}</td>
+			<td>{{.Status}}</td>
+			<td>{{range .Errors}}<div class="error">{{.}}</div>{{end}}{{range .Warnings}}<div class="warning">{{.}}</div>{{end}}</td>
+		</tr>
+		{{end}}
+	</table>
+	{{end}}
+	{{if .Error}}<p>No build information: {{.Error}}</p>{{end}}
+</body>
+</html>
+`))
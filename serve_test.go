@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+/*
+Returns a temp output directory with doc.kml, doc.kmz and an image, and the manifest if withManifest is true.
+ */
+func newServeTestDir(t *testing.T, withManifest bool) string {
+	dir := t.TempDir()
+	files := map[string]string{
+		"doc.kml":     "<kml></kml>",
+		"doc.kmz":     "PK",
+		"files/a.jpg": "jpeg",
+	}
+	if withManifest {
+		files[manifestFilename] = `{"version": 1, "name": "Italy 2024", "built": "2024-05-01T10:00:00Z", "images": {}, "files": [],
+			"report": {"images": [{"file": "b.jpg", "status": "skipped-no-location", "warnings": ["has no location"]}],
+			"totals": {"images": 2, "placed": 1, "skippedNoLocation": 1}}}`
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func serveTestRequest(dir, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	newServeHandler(dir).ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestServeContentTypes(t *testing.T) {
+	dir := newServeTestDir(t, false)
+	for path, want := range map[string]string{
+		"/doc.kml":     "application/vnd.google-earth.kml+xml",
+		"/doc.kmz":     "application/vnd.google-earth.kmz",
+		"/files/a.jpg": "image/jpeg",
+	} {
+		w := serveTestRequest(dir, path)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", path, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != want {
+			t.Errorf("%s: Content-Type %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestServeNotFound(t *testing.T) {
+	dir := newServeTestDir(t, false)
+	secret := filepath.Join(filepath.Dir(dir), "secret.txt")
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secret)
+
+	for _, path := range []string{"/files", "/files/", "/missing.kml", "/../secret.txt", "/files/../../secret.txt"} {
+		if w := serveTestRequest(dir, path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestServeIndex(t *testing.T) {
+	w := serveTestRequest(newServeTestDir(t, true), "/")
+	body := w.Body.String()
+	for _, want := range []string{"Italy 2024", "/viewer", "/doc.kml", "/doc.kmz", "b.jpg", "has no location"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the index page does not contain %q", want)
+		}
+	}
+	if strings.Contains(body, "No build information") {
+		t.Error("the manifest is not read")
+	}
+
+	w = serveTestRequest(newServeTestDir(t, false), "/")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "No build information") {
+		t.Errorf("without a manifest: status %d, body %s", w.Code, w.Body.String())
+	}
+}
+
+func TestServeViewerIsOffline(t *testing.T) {
+	w := serveTestRequest(newServeTestDir(t, false), "/viewer")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	remote := regexp.MustCompile(`(?i)(src|href)\s*=\s*["']?(https?:)?//|fetch\(\s*["'](https?:)?//|url\(\s*["']?(https?:)?//|@import`)
+	if m := remote.FindString(w.Body.String()); m != "" {
+		t.Errorf("the viewer loads a remote URL: %s", m)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"os"
+	filepath2 "path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+An input source of images: a directory, or a list of files read from the standard input.
+ */
+type imageSource struct {
+	dir      string      // normalized root dir of the images; for a file list, their common parent dir
+	files    []string    // files relative to the dir, if the source is a file list (nil for a directory)
+	label    string      // name of the source shown in the map
+	color    *color.RGBA // color of the icon border and the path (nil if not set)
+	drawPath bool        // draw a separate path for the source (if -path is set)
+	filesDir string      // subdirectory in the output files dir for images of this source (empty if there is only one source)
+	images   []string    // image files of the source, see listSourceImages
+	listErr  error       // ~ the error of the listing
+	listed   bool
+}
+
+/*
+Source specifications given by the repeatable -i flag: DIR[,label=LABEL][,color=RRGGBB][,path=BOOL]
+DIR "-" reads a list of image files (one per line) from the standard input.
+ */
+type sourceSpecs []string
+
+func (s *sourceSpecs) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *sourceSpecs) Set(spec string) error {
+	if _, err := parseSourceSpec(spec); err != nil {
+		return err
+	}
+	*s = append(*s, spec)
+	return nil
+}
+
+/*
+Returns the directory part of the source specification.
+ */
+func sourceSpecDir(spec string) string {
+	return strings.SplitN(spec, ",", 2)[0]
+}
+
+/*
+Parses a source specification (see sourceSpecs). The file list is not read yet.
+ */
+func parseSourceSpec(spec string) (*imageSource, error) {
+	parts := strings.Split(spec, ",")
+	src := &imageSource{dir: parts[0], drawPath: true}
+	if src.dir == "" {
+		return nil, fmt.Errorf("missing directory in %q", spec)
+	}
+
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected key=value, got %q", opt)
+		}
+		switch key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); key {
+		case "label":
+			src.label = val
+		case "color":
+			c, err := parseHexColor(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid color %q: %s", val, err)
+			}
+			src.color = &c
+		case "path":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %q: %s", val, err)
+			}
+			src.drawPath = b
+		default:
+			return nil, fmt.Errorf("unknown source option %q", key)
+		}
+	}
+
+	if src.label == "" {
+		if src.dir == "-" {
+			src.label = "stdin"
+		} else {
+			src.label = filepath2.Base(normalizePath(src.dir))
+		}
+	}
+	return src, nil
+}
+
+/*
+Parses the source specifications, reads the file list from the standard input if required
+and sets unique filesDirs if there are more sources.
+ */
+func prepareSources(specs []string) ([]*imageSource, error) {
+	sources := make([]*imageSource, 0, len(specs))
+	usedFilesDirs := map[string]bool{}
+	for _, spec := range specs {
+		src, err := parseSourceSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		if src.dir == "-" {
+			src.dir, src.files, err = readFileList(os.Stdin)
+			if err != nil {
+				return nil, inputError(err)
+			}
+		} else {
+			src.dir = normalizePath(src.dir)
+		}
+
+		if len(specs) > 1 {
+			base := regexp.MustCompile(`[^A-Za-z0-9._-]+`).ReplaceAllString(src.label, "_")
+			src.filesDir = base
+			for n := 2; usedFilesDirs[src.filesDir]; n++ {
+				src.filesDir = fmt.Sprintf("%s-%d", base, n)
+			}
+			usedFilesDirs[src.filesDir] = true
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+/*
+Reads a list of files (one per line, empty lines are skipped) and returns their common parent directory
+and the files relative to it.
+ */
+func readFileList(f *os.File) (dir string, files []string, err error) {
+	var absFiles []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		abs, err := filepath2.Abs(line)
+		if err != nil {
+			return "", nil, err
+		}
+		absFiles = append(absFiles, normalizePath(abs))
+	}
+	if err = scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	if len(absFiles) == 0 {
+		return "", nil, fmt.Errorf("no files listed on the standard input")
+	}
+
+	dir = normalizePath(filepath2.Dir(absFiles[0]))
+	for _, file := range absFiles[1:] {
+		for dir != "/" && !strings.HasPrefix(file, strings.TrimSuffix(dir, "/")+"/") {
+			parent := normalizePath(filepath2.Dir(dir))
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+
+	files = make([]string, len(absFiles))
+	for i, file := range absFiles {
+		files[i] = strings.TrimPrefix(file, strings.TrimSuffix(dir, "/")+"/")
+	}
+	return dir, files, nil
+}
+
+/*
+Returns the directories of the sources.
+ */
+func sourceDirs(sources []*imageSource) []string {
+	dirs := make([]string, len(sources))
+	for i, src := range sources {
+		dirs[i] = src.dir
+	}
+	return dirs
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	filepath2 "path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var trackName = "Track"
+var photoLineWidth = 1.0 // width of the photo-to-photo line drawn together with a track
+
+var tracks []pathSegment // segments of the -path track files (set in setupPath)
+
+/*
+The -path flag: without a value it turns the path on, with a GPX or GeoJSON track file (-path=FILE) it draws
+the track; it can be repeated.
+ */
+type pathFlag struct{}
+
+func (pathFlag) String() string {
+	return strings.Join(trackFiles, " ")
+}
+
+func (pathFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (pathFlag) Set(s string) error {
+	if b, err := strconv.ParseBool(s); err == nil {
+		genPath = b
+		return nil
+	}
+	genPath = true
+	trackFiles = append(trackFiles, s)
+	return nil
+}
+
+/*
+Loads the track files. Returns an error if any of them cannot be loaded.
+ */
+func loadTracks(files []string) ([]pathSegment, error) {
+	var segments []pathSegment
+	for _, file := range files {
+		file = normalizePath(file)
+		var fileSegments []pathSegment
+		var err error
+		switch strings.ToLower(filepath2.Ext(file)) {
+		case ".gpx":
+			fileSegments, err = loadGpxTrack(file)
+		case ".json", ".geojson":
+			fileSegments, err = loadGeoJsonTrack(file)
+		default:
+			err = fmt.Errorf("unsupported track format (use .gpx, .geojson or .json)")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if len(fileSegments) == 0 {
+			return nil, fmt.Errorf("%s: no track found", file)
+		}
+		segments = append(segments, fileSegments...)
+	}
+	return segments, nil
+}
+
+/*
+Only the parts of GPX needed for tracks.
+ */
+type gpxFile struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+	Routes []struct {
+		Points []gpxPoint `xml:"rtept"`
+	} `xml:"rte"`
+}
+
+type gpxPoint struct {
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Ele  *float64 `xml:"ele"`
+	Time string   `xml:"time"`
+}
+
+/*
+Loads track segments (trkseg) and routes (rte) from a GPX file.
+ */
+func loadGpxTrack(filepath string) ([]pathSegment, error) {
+	content, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	var gpx gpxFile
+	if err := xml.Unmarshal(content, &gpx); err != nil {
+		return nil, err
+	}
+
+	var pointLists [][]gpxPoint
+	for _, trk := range gpx.Tracks {
+		for _, seg := range trk.Segments {
+			pointLists = append(pointLists, seg.Points)
+		}
+	}
+	for _, rte := range gpx.Routes {
+		pointLists = append(pointLists, rte.Points)
+	}
+
+	var segments []pathSegment
+	for _, points := range pointLists {
+		segment := make(pathSegment, len(points))
+		for i, pt := range points {
+			segment[i].lonLat = lonLat{pt.Lon, pt.Lat}
+			if pt.Ele != nil {
+				segment[i].alt, segment[i].hasAlt = *pt.Ele, true
+			}
+			if pt.Time != "" {
+				t, err := time.Parse(time.RFC3339, strings.TrimSpace(pt.Time))
+				if err != nil {
+					return nil, err
+				}
+				segment[i].time, segment[i].hasTime = t, true
+			}
+		}
+		if len(segment) > 1 {
+			segments = append(segments, segment)
+		}
+	}
+	return segments, nil
+}
+
+/*
+Loads LineStrings and MultiLineStrings from a GeoJSON file (also inside Features, FeatureCollections
+and GeometryCollections). The times of the points are read from the "coordTimes" or "times" property of the Feature.
+ */
+func loadGeoJsonTrack(filepath string) ([]pathSegment, error) {
+	content, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	var obj geoJsonObject
+	if err := json.Unmarshal(content, &obj); err != nil {
+		return nil, err
+	}
+	return obj.lineStrings(nil)
+}
+
+/*
+Returns the LineStrings in the object as segments. Times are the times of the points of the parent Feature.
+ */
+func (o *geoJsonObject) lineStrings(times json.RawMessage) ([]pathSegment, error) {
+	var segments []pathSegment
+	switch o.Type {
+	case "LineString", "MultiLineString":
+		var lines [][][]float64
+		var lineTimes [][]string
+		if o.Type == "LineString" {
+			var line [][]float64
+			if err := json.Unmarshal(o.Coordinates, &line); err != nil {
+				return nil, err
+			}
+			lines = [][][]float64{line}
+			var t []string
+			if times != nil && json.Unmarshal(times, &t) == nil {
+				lineTimes = [][]string{t}
+			}
+		} else {
+			if err := json.Unmarshal(o.Coordinates, &lines); err != nil {
+				return nil, err
+			}
+			if times != nil {
+				_ = json.Unmarshal(times, &lineTimes) // times are optional
+			}
+		}
+
+		for n, line := range lines {
+			segment := make(pathSegment, 0, len(line))
+			for i, coords := range line {
+				if len(coords) < 2 {
+					return nil, fmt.Errorf("invalid position %v", coords)
+				}
+				p := pathPoint{lonLat: lonLat{coords[0], coords[1]}}
+				if len(coords) > 2 {
+					p.alt, p.hasAlt = coords[2], true
+				}
+				if n < len(lineTimes) && i < len(lineTimes[n]) {
+					t, err := time.Parse(time.RFC3339, lineTimes[n][i])
+					if err != nil {
+						return nil, err
+					}
+					p.time, p.hasTime = t, true
+				}
+				segment = append(segment, p)
+			}
+			if len(segment) > 1 {
+				segments = append(segments, segment)
+			}
+		}
+	case "Feature":
+		if o.Geometry != nil {
+			var props struct {
+				CoordTimes json.RawMessage `json:"coordTimes"`
+				Times      json.RawMessage `json:"times"`
+			}
+			_ = json.Unmarshal(o.Properties, &props) // properties are optional
+			if props.CoordTimes == nil {
+				props.CoordTimes = props.Times
+			}
+			return o.Geometry.lineStrings(props.CoordTimes)
+		}
+	case "FeatureCollection", "GeometryCollection":
+		children := o.Features
+		if o.Type == "GeometryCollection" {
+			children = o.Geometries
+		}
+		for _, child := range children {
+			childSegments, err := child.lineStrings(nil)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, childSegments...)
+		}
+	}
+	return segments, nil
+}
+
+/*
+Returns the track segments trimmed to the time span of the located images with time. Points without time
+are kept. Nothing is trimmed if no image has time.
+ */
+func trimTracks(segments []pathSegment, images []*imagePlacemark) []pathSegment {
+	var from, to time.Time
+	for _, img := range images {
+		if img.hasLocation && img.hasDateTime {
+			if from.IsZero() || img.dateTime.Before(from) {
+				from = img.dateTime
+			}
+			if to.IsZero() || img.dateTime.After(to) {
+				to = img.dateTime
+			}
+		}
+	}
+	if from.IsZero() {
+		return segments
+	}
+
+	var trimmed []pathSegment
+	for _, segment := range segments {
+		var kept pathSegment
+		for _, p := range segment {
+			if !p.hasTime || !p.time.Before(from) && !p.time.After(to) {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) > 1 {
+			trimmed = append(trimmed, kept)
+		}
+	}
+	return trimmed
+}
+
+/*
+Returns the parts of the segments outside the privacy zones: points in a zone are left out and the segments
+are split wherever they would enter a zone.
+ */
+func cutPrivacyZones(segments []pathSegment) []pathSegment {
+	var out []pathSegment
+	for _, segment := range segments {
+		var part pathSegment
+		for _, p := range segment {
+			if findPrivacyZone(p.lonLat) != nil {
+				if len(part) > 1 {
+					out = append(out, part)
+				}
+				part = nil
+				continue
+			}
+			if len(part) > 0 && segmentEntersPrivacyZone(part[len(part)-1].lonLat, p.lonLat) {
+				if len(part) > 1 {
+					out = append(out, part)
+				}
+				part = nil
+			}
+			part = append(part, p)
+		}
+		if len(part) > 1 {
+			out = append(out, part)
+		}
+	}
+	return out
+}
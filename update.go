@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	filepath2 "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const manifestFilename = "photo-map-manifest.json"
+const manifestVersion = 1
+
+// flags whose values change the resized images, the icons or the fingerprints
+var imageSettingFlags = []string{"maxsize", "format", "quality", "progressive", "resample", "sharpen", "thumbsize", "thumbformat",
+	"icon-shape", "icon-border", "icon-shadow", "watermark-text", "watermark-logo", "watermark-position",
+	"watermark-opacity", "watermark-scale", "keep-meta", "duplicates", "duplicates-hash"}
+
+var previousManifest *buildManifest // the manifest of the previous build (-update), nil if there is none
+var manifest *buildManifest         // the manifest of this build
+var settingsHash string             // hash of the image settings (see imageSettingFlags)
+
+/*
+The manifest of a build, written to the output directory. -update uses it to find the images that have not
+changed and the files that are not needed anymore.
+ */
+type buildManifest struct {
+	Version int                      `json:"version"`
+	Name    string                   `json:"name,omitempty"` // the project name
+	Built   string                   `json:"built"`          // time of the build (RFC 3339)
+	Images  map[string]manifestImage `json:"images"`         // by the path of the original file
+	Files   []string                 `json:"files"`          // all files written to the output directory (relative to it)
+	Report  *buildReport             `json:"report"`         // the report of the build (shown by the serve command)
+}
+
+/*
+An image in the manifest.
+ */
+type manifestImage struct {
+	Input      string  `json:"input"`                // hash of the input file, the image settings and the output paths
+	Image      string  `json:"image,omitempty"`      // path of the resized image in the output directory
+	Icon       string  `json:"icon,omitempty"`       // ~ of the icon
+	Badge      string  `json:"badge,omitempty"`      // count badge added to the icon (-duplicates collapse)
+	Perceptual string  `json:"perceptual,omitempty"` // perceptual hash (hex), see -duplicates-hash
+	Sharpness  float64 `json:"sharpness,omitempty"`
+}
+
+/*
+Starts a new manifest and, with -update, loads the manifest of the previous build from the output directory.
+If there is none, everything is built (and no files are removed).
+ */
+func setupUpdate() error {
+	manifest = &buildManifest{Version: manifestVersion, Images: map[string]manifestImage{}, Files: []string{}}
+	settingsHash = computeSettingsHash()
+	if !update {
+		return nil
+	}
+	if base64images || kmzOnly {
+		return fmt.Errorf("-update cannot be used with -base64 or -kmz-only")
+	}
+
+	m, err := loadManifest()
+	if err != nil {
+		return err
+	} else if m == nil {
+		slog.Info("There is no manifest of a previous build in the output directory (or it has another version), everything is built")
+		return nil
+	}
+	previousManifest = m
+	return nil
+}
+
+/*
+Loads the manifest of the previous build from the output directory. Returns nil if there is none
+or it has another version.
+ */
+func loadManifest() (*buildManifest, error) {
+	path := joinPaths(outDir, manifestFilename)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, inputError(err)
+	}
+	m := &buildManifest{}
+	if err := json.Unmarshal(content, m); err != nil {
+		return nil, inputError(fmt.Errorf("%s: %w", path, err))
+	}
+	if m.Version != manifestVersion {
+		return nil, nil
+	}
+	return m, nil
+}
+
+/*
+Adds the images and files of the manifest in the output directory to the manifest of this build (-append),
+so that the manifest covers the whole map. Images of this build replace the ones with the same key, files that
+do not exist anymore are dropped.
+ */
+func mergeExistingManifest() error {
+	m, err := loadManifest()
+	if err != nil || m == nil {
+		return err
+	}
+	for key, entry := range m.Images {
+		if _, ok := manifest.Images[key]; !ok {
+			manifest.Images[key] = entry
+		}
+	}
+	listed := map[string]bool{manifestFilename: true}
+	for _, f := range manifest.Files {
+		listed[f] = true
+	}
+	for _, f := range m.Files {
+		if listed[f] {
+			continue
+		}
+		listed[f] = true
+		if _, err := os.Stat(joinPaths(outDir, f)); err == nil {
+			manifest.Files = append(manifest.Files, f)
+		}
+	}
+	return nil
+}
+
+/*
+Returns the hash of the flags that change the resized images or icons (and of the watermark logo file).
+ */
+func computeSettingsHash() string {
+	h := sha256.New()
+	for _, name := range imageSettingFlags {
+		if f := flag.Lookup(name); f != nil {
+			fmt.Fprintf(h, "%s=%s\n", name, f.Value.String())
+		}
+	}
+	if watermarkLogo != "" {
+		if info, err := os.Stat(watermarkLogo); err == nil {
+			fmt.Fprintf(h, "logo %d %d\n", info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+/*
+Returns the key of the image in the manifest: the absolute path of its original file.
+ */
+func (i *imagePlacemark) manifestKey() string {
+	return absPath(joinPaths(i.source.dir, i.origPath))
+}
+
+/*
+Returns the hash of everything the files of the image are made from: the original file (its size and modification
+time), the image settings, its icon style and its output paths. Returns an empty string if the file cannot be read.
+ */
+func (i *imagePlacemark) computeInputHash() string {
+	info, err := os.Stat(i.manifestKey())
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d %d\n%s\n%s\n", settingsHash, info.Size(), info.ModTime().UnixNano(), i.pathInKml, i.iconPathInKml)
+	style := i.iconStyle()
+	fmt.Fprintf(h, "%+v %v\n", style, i.iconBorderColor(style.border))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+/*
+Marks the images whose files in the output directory are up to date (-update), so that they are not decoded
+and resized again. Their fingerprints are restored from the manifest. Returns the number of such images.
+ */
+func findUpToDateImages(images []*imagePlacemark) int {
+	if previousManifest == nil {
+		return 0
+	}
+	n := 0
+	for _, img := range images {
+		if img.source == nil {
+			continue
+		}
+		prev, ok := previousManifest.Images[img.manifestKey()]
+		if !ok || prev.Input == "" || prev.Input != img.computeInputHash() || !img.hasOutputFiles(prev) {
+			continue
+		}
+		if img.fingerprint != nil {
+			if duplicatesHash != "none" {
+				perceptual, err := strconv.ParseUint(prev.Perceptual, 16, 64)
+				if err != nil {
+					continue
+				}
+				img.fingerprint.perceptual, img.fingerprint.hasPerceptual = perceptual, true
+			}
+			img.fingerprint.sharpness = prev.Sharpness
+		}
+		img.upToDate = true
+		n++
+	}
+	return n
+}
+
+/*
+Returns true if the files of the image recorded in the manifest are the ones the image needs and they exist
+in the output directory.
+ */
+func (i *imagePlacemark) hasOutputFiles(prev manifestImage) bool {
+	var needed []string
+	if i.isInternal {
+		needed = append(needed, i.pathInKml)
+	}
+	if i.isIconInternal {
+		needed = append(needed, i.iconPathInKml)
+	}
+	for _, path := range needed {
+		if path != prev.Image && path != prev.Icon {
+			return false
+		}
+		if _, err := os.Stat(joinPaths(outDir, path)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Returns true if the image is up to date, but its count badge (-duplicates collapse) differs from the one
+in its icon, so the icon has to be created again.
+ */
+func (i *imagePlacemark) hasChangedCountBadge() bool {
+	return i.upToDate && previousManifest != nil && previousManifest.Images[i.manifestKey()].Badge != i.countBadge
+}
+
+/*
+Adds the image and its collapsed duplicates, with the files they have in the output directory, to the manifest.
+ */
+func addToManifest(img *imagePlacemark) {
+	addImageToManifest(img, img.isIconInternal)
+	for _, dup := range img.duplicates {
+		addImageToManifest(dup, dup.isIconInternal && dup.upToDate) // the icon of a collapsed image is not copied
+	}
+}
+
+/*
+Adds the image to the manifest. If the image has no icon in the output directory, it is built again next time.
+ */
+func addImageToManifest(img *imagePlacemark, hasIcon bool) {
+	if img.source == nil {
+		return
+	}
+	entry := manifestImage{Input: img.computeInputHash(), Badge: img.countBadge}
+	if img.isInternal {
+		entry.Image = img.pathInKml
+		manifest.Files = append(manifest.Files, entry.Image)
+	}
+	if hasIcon {
+		entry.Icon = img.iconPathInKml
+		manifest.Files = append(manifest.Files, entry.Icon)
+	}
+	if img.fingerprint != nil {
+		if img.fingerprint.hasPerceptual {
+			entry.Perceptual = strconv.FormatUint(img.fingerprint.perceptual, 16)
+		}
+		entry.Sharpness = img.fingerprint.sharpness
+	}
+	if len(img.errors) > 0 || img.isIconInternal && !hasIcon {
+		entry.Input = "" // built again next time
+	}
+	manifest.Images[img.manifestKey()] = entry
+}
+
+/*
+Writes the manifest with the other written files (relative to the output directory), merged into the existing
+manifest with -append (nothing is written with -kmz-only). With -update, removes the files of the previous build
+that have not been written this time. Only files listed in the previous manifest are removed, together with
+the directories they leave empty. Returns the number of removed files.
+ */
+func writeManifest(otherFiles ...string) (removed int, err error) {
+	if kmzOnly { // the output directory holds only the KMZ file
+		return 0, nil
+	}
+	manifest.Files = append(manifest.Files, otherFiles...)
+	if appendMap != nil {
+		if err := mergeExistingManifest(); err != nil {
+			return 0, err
+		}
+	}
+	sort.Strings(manifest.Files)
+	manifest.Name, manifest.Built = name, time.Now().Format(time.RFC3339)
+	finishReport()
+	manifest.Report = report
+	written := map[string]bool{manifestFilename: true}
+	for _, f := range manifest.Files {
+		written[f] = true
+	}
+
+	if previousManifest != nil {
+		for _, f := range previousManifest.Files {
+			if written[f] || filepath2.IsAbs(f) || f == ".." || strings.HasPrefix(f, "../") {
+				continue
+			}
+			if err := os.Remove(joinPaths(outDir, f)); err != nil && !os.IsNotExist(err) {
+				return removed, outputError(err)
+			}
+			removed++
+			for dir := filepath2.Dir(f); dir != "." && dir != "/"; dir = filepath2.Dir(dir) {
+				if os.Remove(joinPaths(outDir, dir)) != nil { // not empty
+					break
+				}
+			}
+		}
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return removed, err
+	}
+	return removed, outputError(ioutil.WriteFile(joinPaths(outDir, manifestFilename), append(content, '\n'), 0644))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFindUpToDateImages(t *testing.T) {
+	defer func(dir string, prev *buildManifest, hash string) {
+		outDir, previousManifest, settingsHash = dir, prev, hash
+	}(outDir, previousManifest, settingsHash)
+	dir := t.TempDir()
+	srcDir, out := normalizePath(filepath.Join(dir, "photos")), normalizePath(filepath.Join(dir, "map"))
+	outDir, settingsHash = out, "settings"
+	writeTestFile(t, filepath.Join(srcDir, "a.jpg"), "jpeg")
+	writeTestFile(t, filepath.Join(out, "files/a.jpg"), "resized")
+	writeTestFile(t, filepath.Join(out, "files/.thumbnails/a.jpg.png"), "icon")
+
+	newImage := func() *imagePlacemark {
+		return &imagePlacemark{source: &imageSource{dir: srcDir}, path: "a.jpg", origPath: "a.jpg", rootDir: srcDir,
+			isInternal: true, isIconInternal: true, pathInKml: "files/a.jpg", iconPathInKml: "files/.thumbnails/a.jpg.png"}
+	}
+	img := newImage()
+	entry := manifestImage{Input: img.computeInputHash(), Image: img.pathInKml, Icon: img.iconPathInKml}
+	previousManifest = &buildManifest{Version: manifestVersion, Images: map[string]manifestImage{img.manifestKey(): entry}}
+
+	check := func(name string, want bool) {
+		t.Helper()
+		img := newImage()
+		if n := findUpToDateImages([]*imagePlacemark{img}); (n == 1) != want || img.upToDate != want {
+			t.Errorf("%s: up to date %v, want %v", name, img.upToDate, want)
+		}
+	}
+	check("unchanged", true)
+
+	settingsHash = "other settings"
+	check("other settings", false)
+	settingsHash = "settings"
+
+	img.iconOptions = dataObj{"shape": "circle"}
+	previousManifest.Images[img.manifestKey()] = manifestImage{Input: img.computeInputHash(), Image: entry.Image, Icon: entry.Icon}
+	check("other icon style", false)
+	previousManifest.Images[img.manifestKey()] = entry
+
+	if err := os.Remove(filepath.Join(out, "files/.thumbnails/a.jpg.png")); err != nil {
+		t.Fatal(err)
+	}
+	check("missing icon", false)
+	writeTestFile(t, filepath.Join(out, "files/.thumbnails/a.jpg.png"), "icon")
+	check("icon written again", true)
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(srcDir, "a.jpg"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	check("modified original", false)
+}
@@ -0,0 +1,204 @@
+package main
+
+/*
+The static web viewer of the serve command (/viewer). It loads doc.kml and draws the placemarks (their icons)
+and the paths on a plain Mercator map with a graticule; there are no map tiles, so it works offline.
+Clicking an icon shows its images and description. Drag to move, scroll to zoom.
+ */
+const viewerHtml = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>photo-map viewer</title>
+	<style>
+		html, body {margin: 0; height: 100%; font-family: sans-serif;}
+		#map {display: block; width: 100%; height: 100%; background: #dde7ee; cursor: grab; user-select: none;}
+		#info {position: absolute; top: 8px; left: 8px; padding: 4px 8px; border-radius: 4px; font-size: 13px; background: rgba(255, 255, 255, 0.85);}
+		#popup {display: none; position: absolute; top: 0; right: 0; bottom: 0; width: 480px; max-width: 100%; box-sizing: border-box;
+			padding: 8px; overflow: auto; background: #fff; box-shadow: 0 0 8px rgba(0, 0, 0, 0.3);}
+		#popup img {display: block; max-width: 100%; margin-bottom: 8px;}
+		#close {float: right; border: none; background: none; font-size: 20px; cursor: pointer;}
+		.grid {stroke: #fff; stroke-width: 1;}
+		.label {fill: #789; font-size: 11px;}
+	</style>
+</head>
+<body>
+	<svg id="map"></svg>
+	<div id="info"><a href="/">Build</a> &middot; <span id="status">Loading doc.kml...</span></div>
+	<div id="popup"><button id="close">&times;</button><div id="content"></div></div>
+	<script>
+	"use strict";
+	const gxNs = "http://www.google.com/kml/ext/2.2", svgNs = "http://www.w3.org/2000/svg";
+	const svg = document.getElementById("map");
+	const iconSize = 32;
+	let places = [], lines = [], view = null;
+
+	function childText(el, tag) {
+		const e = el.getElementsByTagName(tag)[0];
+		return e ? e.textContent.trim() : "";
+	}
+
+	function mercatorY(lat) {
+		lat = Math.max(-85, Math.min(85, lat));
+		return Math.log(Math.tan(Math.PI / 4 + lat * Math.PI / 360)) * 180 / Math.PI;
+	}
+
+	function parseCoordinates(text, separator) {
+		return text.trim().split(separator).map(c => c.trim().split(/[\s,]+/).map(Number))
+			.filter(c => c.length >= 2 && !isNaN(c[0]) && !isNaN(c[1]));
+	}
+
+	function kmlColor(color) { // aabbggrr
+		if (!/^[0-9a-fA-F]{8}$/.test(color)) return "#ff7f00";
+		const [a, b, g, r] = color.match(/../g).map(h => parseInt(h, 16));
+		return "rgba(" + r + "," + g + "," + b + "," + (a / 255) + ")";
+	}
+
+	function imageUrls(pm) {
+		const urls = Array.from(pm.getElementsByTagNameNS(gxNs, "ImageUrl"), e => e.textContent.trim());
+		for (const tag of ["description", "text"]) {
+			for (const e of pm.getElementsByTagName(tag)) {
+				for (const m of e.textContent.matchAll(/<img[^>]*\ssrc="([^"]+)"/g)) urls.push(m[1]);
+			}
+		}
+		if (pm.tagName === "PhotoOverlay") urls.push(childText(pm, "href"));
+		return [...new Set(urls.filter(u => u))];
+	}
+
+	function load(doc) {
+		const styles = {};
+		for (const s of doc.getElementsByTagName("Style")) {
+			if (s.getAttribute("id")) styles[s.getAttribute("id")] = s;
+		}
+		for (const pm of [...doc.getElementsByTagName("Placemark"), ...doc.getElementsByTagName("PhotoOverlay")]) {
+			let style = pm.getElementsByTagName("Style")[0];
+			const url = childText(pm, "styleUrl");
+			if (!style && url.startsWith("#")) style = styles[url.slice(1)];
+			const name = childText(pm, "name");
+			const description = new DOMParser().parseFromString(childText(pm, "description"), "text/html").body.textContent.trim();
+
+			const point = pm.getElementsByTagName("Point")[0];
+			if (point) {
+				const c = parseCoordinates(childText(point, "coordinates"), /\s+/)[0];
+				const iconStyle = style && style.getElementsByTagName("IconStyle")[0];
+				if (c) places.push({lon: c[0], lat: c[1], name, description, icon: iconStyle ? childText(iconStyle, "href") : "", images: imageUrls(pm)});
+			}
+			const lineStyle = style && style.getElementsByTagName("LineStyle")[0];
+			const color = kmlColor(lineStyle ? childText(lineStyle, "color") : "");
+			const width = lineStyle && childText(lineStyle, "width") || 2;
+			for (const ls of pm.getElementsByTagName("LineString")) {
+				lines.push({coords: parseCoordinates(childText(ls, "coordinates"), /\s+/), color, width});
+			}
+			for (const track of pm.getElementsByTagNameNS(gxNs, "Track")) {
+				const coords = Array.from(track.getElementsByTagNameNS(gxNs, "coord"), e => e.textContent.trim().split(/\s+/).map(Number));
+				lines.push({coords, color, width});
+			}
+		}
+		const n = places.length;
+		document.getElementById("status").textContent = n + " placemark" + (n === 1 ? "" : "s");
+		fit();
+	}
+
+	function fit() {
+		const all = [...places.map(p => [p.lon, p.lat]), ...lines.flatMap(l => l.coords)];
+		if (all.length === 0) all.push([0, 0]);
+		const xs = all.map(c => c[0]), ys = all.map(c => mercatorY(c[1]));
+		const minX = Math.min(...xs), maxX = Math.max(...xs), minY = Math.min(...ys), maxY = Math.max(...ys);
+		const k = 0.8 * Math.min(svg.clientWidth / Math.max(maxX - minX, 0.001), svg.clientHeight / Math.max(maxY - minY, 0.001));
+		view = {x: (minX + maxX) / 2, y: (minY + maxY) / 2, k: Math.min(k, 1e6)};
+		render();
+	}
+
+	function project(lon, lat) {
+		return [(lon - view.x) * view.k + svg.clientWidth / 2, (view.y - mercatorY(lat)) * view.k + svg.clientHeight / 2];
+	}
+
+	function add(tag, attrs, parent) {
+		const el = document.createElementNS(svgNs, tag);
+		for (const [k, v] of Object.entries(attrs)) el.setAttribute(k, v);
+		(parent || svg).appendChild(el);
+		return el;
+	}
+
+	function render() {
+		svg.textContent = "";
+		const w = svg.clientWidth, h = svg.clientHeight;
+		const span = w / view.k;
+		const step = [0.001, 0.002, 0.005, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1, 2, 5, 10, 20, 30].find(s => span / s <= 10) || 30;
+		const west = view.x - w / 2 / view.k, east = view.x + w / 2 / view.k;
+		for (let lon = Math.ceil(west / step) * step; lon <= east; lon += step) {
+			const x = project(lon, 0)[0];
+			add("line", {x1: x, y1: 0, x2: x, y2: h, class: "grid"});
+			add("text", {x: x + 2, y: h - 4, class: "label"}).textContent = +lon.toFixed(3) + "°";
+		}
+		const y2lat = y => Math.atan(Math.sinh(y * Math.PI / 180)) * 180 / Math.PI;
+		const south = y2lat(view.y - h / 2 / view.k), north = y2lat(view.y + h / 2 / view.k);
+		for (let lat = Math.ceil(south / step) * step; lat <= north; lat += step) {
+			const y = project(0, lat)[1];
+			add("line", {x1: 0, y1: y, x2: w, y2: y, class: "grid"});
+			add("text", {x: 2, y: y - 2, class: "label"}).textContent = +lat.toFixed(3) + "°";
+		}
+		for (const l of lines) {
+			const points = l.coords.map(c => project(c[0], c[1]).join(",")).join(" ");
+			add("polyline", {points, fill: "none", stroke: l.color, "stroke-width": l.width});
+		}
+		for (const p of places) {
+			const [x, y] = project(p.lon, p.lat);
+			const el = p.icon
+				? add("image", {href: p.icon, x: x - iconSize / 2, y: y - iconSize / 2, width: iconSize, height: iconSize})
+				: add("circle", {cx: x, cy: y, r: 6, fill: "#e33", stroke: "#fff"});
+			add("title", {}, el).textContent = p.name;
+			el.style.cursor = "pointer";
+			el.addEventListener("click", () => show(p));
+		}
+	}
+
+	function show(p) {
+		const content = document.getElementById("content");
+		content.textContent = "";
+		const title = document.createElement("h3");
+		title.textContent = p.name;
+		content.appendChild(title);
+		for (const url of p.images) {
+			const img = document.createElement("img");
+			img.src = url;
+			content.appendChild(img);
+		}
+		const description = document.createElement("p");
+		description.textContent = p.description;
+		content.appendChild(description);
+		document.getElementById("popup").style.display = "block";
+	}
+
+	document.getElementById("close").addEventListener("click", () => document.getElementById("popup").style.display = "none");
+
+	let drag = null;
+	svg.addEventListener("pointerdown", e => { drag = {x: e.clientX, y: e.clientY}; svg.setPointerCapture(e.pointerId); });
+	svg.addEventListener("pointerup", () => drag = null);
+	svg.addEventListener("pointermove", e => {
+		if (!drag || !view) return;
+		view.x -= (e.clientX - drag.x) / view.k;
+		view.y += (e.clientY - drag.y) / view.k;
+		drag = {x: e.clientX, y: e.clientY};
+		render();
+	});
+	svg.addEventListener("wheel", e => {
+		if (!view) return;
+		e.preventDefault();
+		const factor = e.deltaY < 0 ? 1.25 : 0.8;
+		const dx = e.offsetX - svg.clientWidth / 2, dy = e.offsetY - svg.clientHeight / 2;
+		view.x += dx / view.k - dx / (view.k * factor);
+		view.y -= dy / view.k - dy / (view.k * factor);
+		view.k *= factor;
+		render();
+	}, {passive: false});
+	window.addEventListener("resize", () => view && render());
+
+	fetch("doc.kml")
+		.then(r => { if (!r.ok) throw new Error("doc.kml: " + r.status + " " + r.statusText); return r.text(); })
+		.then(text => load(new DOMParser().parseFromString(text, "application/xml")))
+		.catch(err => document.getElementById("status").textContent = err.message);
+	</script>
+</body>
+</html>
+`
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	filepath2 "path/filepath"
+	"regexp"
+	"strings"
+)
+
+const ignoreFilename = ".photomapignore"
+
+/*
+A pattern from a .photomapignore file (gitignore-style) or from -include/-exclude.
+ */
+type ignoreRule struct {
+	re      *regexp.Regexp // matches paths relative to the base
+	base    string         // root-relative dir of the ignore file (empty for the root)
+	negate  bool           // pattern starting with !
+	dirOnly bool           // pattern ending with /
+}
+
+/*
+Returns true if the rule matches the root-relative path.
+ */
+func (r ignoreRule) matches(path string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(path, r.base+"/") {
+			return false
+		}
+		path = strings.TrimPrefix(path, r.base+"/")
+	}
+	return r.re.MatchString(path)
+}
+
+/*
+Parses a gitignore-style pattern. Returns false if the line is empty or a comment.
+A pattern without a slash (except a trailing one) matches in any directory below the base,
+otherwise it is relative to the base.
+ */
+func parseIgnoreRule(line, base string) (rule ignoreRule, ok bool, err error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+	rule.base = base
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) { // \# and \!
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+	rule.re, err = compileGlob(line)
+	return rule, err == nil, err
+}
+
+/*
+Loads rules from the ignore file in the dir (root-relative base). Returns nil if there is no ignore file.
+ */
+func loadIgnoreFile(dir, base string) ([]ignoreRule, error) {
+	f, err := os.Open(joinPaths(dir, ignoreFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rule, ok, err := parseIgnoreRule(scanner.Text(), base)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+/*
+Returns true if the path is ignored by the rules. The last matching rule wins.
+ */
+func isIgnored(rules []ignoreRule, path string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.matches(path, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+/*
+Returns the rules of the -include or -exclude patterns.
+ */
+func compilePatternList(patterns []string) ([]ignoreRule, error) {
+	rules := make([]ignoreRule, 0, len(patterns))
+	for _, pattern := range patterns {
+		rule, ok, err := parseIgnoreRule(pattern, "")
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+/*
+Returns true if the root-relative path of an image file passes the -include and -exclude patterns.
+ */
+func isIncluded(path string) bool {
+	if len(includeRules) > 0 && !isIgnored(includeRules, path, false) {
+		return false
+	}
+	return !isIgnored(excludeRules, path, false)
+}
+
+/*
+Calls fn for every image file of the source (with its root-relative path), in lexical order.
+Hidden files and dirs (unless -hidden), .thumbnails dirs, the output directory and paths excluded by -include, -exclude or .photomapignore
+files are skipped. Symlinks are followed only with -follow-symlinks.
+Returns an input error if the source dir does not exist or cannot be read; errors in its subdirs and files
+are logged (and fail the build with -strict).
+ */
+func walkSourceImages(src *imageSource, fn func(path string)) error {
+	if src.files != nil {
+		for _, path := range src.files {
+			info, err := os.Stat(joinPaths(src.dir, path))
+			if err != nil {
+				printIfErr(err, exitInput)
+			} else if !info.Mode().IsRegular() || !isImage(info) {
+				warn(path + " is not an image file")
+			} else if isIncluded(path) {
+				fn(path)
+			}
+		}
+		return nil
+	}
+
+	realRoot, err := filepath2.EvalSymlinks(src.dir)
+	if err != nil {
+		return inputError(err)
+	}
+	return inputError(walkImagesDir(src.dir, "", nil, map[string]bool{realRoot: true}, fn))
+}
+
+/*
+Returns the root-relative paths of the image files of the source, see walkSourceImages. The source is walked
+only once, so the data file validation and the indexing see the same files.
+ */
+func listSourceImages(src *imageSource) ([]string, error) {
+	if !src.listed {
+		src.images = []string{}
+		src.listErr = walkSourceImages(src, func(path string) {
+			src.images = append(src.images, path)
+		})
+		src.listed = true
+	}
+	return src.images, src.listErr
+}
+
+/*
+Walks the dir (with the root-relative path rel) recursively, see walkSourceImages.
+Rules are the ignore rules of the parent dirs, ancestors are real paths of the dirs being walked (to detect loops).
+Returns an error if the dir cannot be read.
+ */
+func walkImagesDir(dir, rel string, rules []ignoreRule, ancestors map[string]bool, fn func(path string)) error {
+	dirRules, err := loadIgnoreFile(dir, rel)
+	printIfErr(err, exitInput)
+	rules = append(rules[:len(rules):len(rules)], dirRules...)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range entries {
+		name := info.Name()
+		path := joinPaths(rel, name)
+		fullPath := joinPaths(dir, name)
+
+		if name == ".thumbnails" || (!includeHidden && strings.HasPrefix(name, ".")) {
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !followSymlinks {
+				continue
+			}
+			info, err = os.Stat(fullPath)
+			if err != nil {
+				printIfErr(err, exitInput)
+				continue
+			}
+		}
+
+		if info.IsDir() {
+			if isIgnored(rules, path, true) || isIgnored(excludeRules, path, true) || outDir != "" && absPath(fullPath) == absPath(outDir) {
+				continue
+			}
+			realPath, err := filepath2.EvalSymlinks(fullPath)
+			if err != nil {
+				printIfErr(err, exitInput)
+				continue
+			}
+			if ancestors[realPath] {
+				warn("Skipping " + fullPath + " - symlink loop")
+				continue
+			}
+			ancestors[realPath] = true
+			printIfErr(walkImagesDir(fullPath, path, rules, ancestors, fn), exitInput)
+			delete(ancestors, realPath)
+		} else if info.Mode().IsRegular() && isImage(info) && !isIgnored(rules, path, false) && isIncluded(path) {
+			fn(path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWalkSourceImagesMissingDir(t *testing.T) {
+	src := &imageSource{dir: filepath.Join(t.TempDir(), "missing")}
+	err := walkSourceImages(src, func(path string) {
+		t.Errorf("unexpected image %s", path)
+	})
+	if err == nil {
+		t.Fatal("no error for a missing source dir")
+	}
+	if code := exitCode(err, exitFailure); code != exitInput {
+		t.Errorf("exit code %d, want %d", code, exitInput)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/twpayne/go-kml"
+	"log/slog"
+	"os"
+	"os/exec"
+	filepath2 "path/filepath"
+	"time"
+)
+
+const networkLinkFilename = "network-link.kml"
+
+/*
+Checks the watch flags. Returns an error if they cannot be used with the other flags.
+ */
+func setupWatch() error {
+	if !watch {
+		if watchNetworkLink {
+			return fmt.Errorf("-watch-network-link requires -watch")
+		}
+		return nil
+	}
+	if command != "" {
+		return fmt.Errorf("-watch cannot be used with the %s command", command)
+	}
+	if dryRun || base64images || kmzOnly {
+		return fmt.Errorf("-watch cannot be used with -dry-run, -base64 or -kmz-only")
+	}
+	for _, src := range sources {
+		if src.files != nil {
+			return fmt.Errorf("-watch cannot be used with a file list from the standard input")
+		}
+	}
+	if watchInterval <= 0 || watchDebounce < 0 {
+		return fmt.Errorf("-watch-interval has to be positive and -watch-debounce cannot be negative")
+	}
+	return nil
+}
+
+/*
+Builds the map and keeps rebuilding it (with -update) whenever the input directories or the other input files
+change. A burst of changes is waited out (-watch-debounce) before the build starts. Each build runs as a child
+process with the same arguments, so the configuration file is loaded again and a failed build does not stop
+the watching. Never returns.
+ */
+func runWatch() {
+	if watchNetworkLink {
+		fatalIfErr(writeNetworkLink(), exitOutput)
+		slog.Info("Open " + joinPaths(outDir, networkLinkFilename) + " in Google Earth Pro to see the changes")
+	}
+	executable, err := os.Executable()
+	fatalIfErr(err, exitFailure)
+	args := append(os.Args[1:], "-watch=false", "-watch-network-link=false", "-update")
+
+	snapshot := takeInputSnapshot()
+	runWatchBuild(executable, args)
+	for {
+		time.Sleep(watchInterval)
+		current := takeInputSnapshot()
+		if current == snapshot {
+			continue
+		}
+		slog.Info("Changes detected, waiting until they stop...")
+		lastChange := time.Now()
+		for time.Since(lastChange) < watchDebounce {
+			time.Sleep(watchInterval)
+			if next := takeInputSnapshot(); next != current {
+				current, lastChange = next, time.Now()
+			}
+		}
+		snapshot = current
+		runWatchBuild(executable, args)
+	}
+}
+
+/*
+Runs one build as a child process and logs its result.
+ */
+func runWatchBuild(executable string, args []string) {
+	slog.Info("Building...")
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		slog.Error("The build failed, waiting for changes", "error", err)
+	} else {
+		slog.Info("Waiting for changes...")
+	}
+}
+
+/*
+Returns a hash of the names, sizes and modification times of all files in the input directories (except
+the output directory and the report, which are written by the build) and of the other input files:
+the configuration file, the data file, the tracks, the polygon and the watermark logo.
+ */
+func takeInputSnapshot() string {
+	written := map[string]bool{absPath(outDir): true}
+	if reportFilepath != "" {
+		written[absPath(reportFilepath)] = true
+	}
+
+	h := sha256.New()
+	for _, src := range sources {
+		filepath2.Walk(src.dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintf(h, "%s error\n", path)
+				return nil
+			}
+			if written[absPath(path)] {
+				if info.IsDir() {
+					return filepath2.SkipDir
+				}
+				return nil
+			}
+			fmt.Fprintf(h, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+	}
+	files := append([]string{configFilepath, dataFilepath, polygonFilepath, watermarkLogo}, trackFiles...)
+	for _, path := range files {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(h, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		} else {
+			fmt.Fprintf(h, "%s missing\n", path)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+/*
+Writes the root KML with a NetworkLink to doc.kml into the output directory. Google Earth Pro reloads the linked
+document periodically, so an open view shows the rebuilt map by itself.
+ */
+func writeNetworkLink() error {
+	linkName := name
+	if linkName == "" {
+		linkName = "photo-map"
+	}
+	k := kml.KML(
+		kml.NetworkLink(
+			kml.Name(linkName),
+			kml.Open(true),
+			kml.Link(
+				kml.Href("doc.kml"),
+				kml.RefreshMode(kml.RefreshModeOnInterval),
+				kml.RefreshInterval(watchInterval.Seconds()),
+			),
+		),
+	)
+	f, err := createFile(joinPaths(outDir, networkLinkFilename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return k.WriteIndent(f, "", "  ")
+}
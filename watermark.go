@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+var watermarkPositions = []string{"top-left", "top", "top-right", "left", "center", "right", "bottom-left", "bottom", "bottom-right"}
+var watermarkMargin = 0.02 // relative to the shorter side of the image
+
+var watermark image.Image // the text or the logo (set in setupWatermark), nil if there is no watermark
+
+/*
+Checks the watermark flags and prepares the watermark image. Returns an error if any of them is invalid.
+ */
+func setupWatermark() error {
+	if watermarkText != "" && watermarkLogo != "" {
+		return fmt.Errorf("-watermark-text and -watermark-logo cannot be used together")
+	}
+	if !containsString(watermarkPositions, watermarkPosition) {
+		return fmt.Errorf("-watermark-position has to be one of: %s", strings.Join(watermarkPositions, ", "))
+	}
+	if watermarkOpacity <= 0 || watermarkOpacity > 1 {
+		return fmt.Errorf("-watermark-opacity has to be greater than 0 and at most 1")
+	}
+	if watermarkScale <= 0 || watermarkScale > 1 {
+		return fmt.Errorf("-watermark-scale has to be greater than 0 and at most 1")
+	}
+
+	if watermarkText != "" {
+		watermark = renderText(watermarkText)
+	} else if watermarkLogo != "" {
+		logo, err := imaging.Open(normalizePath(watermarkLogo))
+		if err != nil {
+			return inputError(fmt.Errorf("-watermark-logo: %w", err))
+		}
+		watermark = logo
+	}
+	return nil
+}
+
+/*
+Returns the text rendered in white with a dark outline on a transparent background.
+ */
+func renderText(text string) *image.NRGBA {
+	face := basicfont.Face7x13
+	drawer := font.Drawer{Face: face}
+	width := drawer.MeasureString(text).Ceil()
+	out := image.NewNRGBA(image.Rect(0, 0, width+2, face.Height+2))
+
+	drawer.Dst = out
+	drawer.Src = image.NewUniform(color.NRGBA{A: 0xa0})
+	for _, d := range []image.Point{{0, 1}, {2, 1}, {1, 0}, {1, 2}} {
+		drawer.Dot = fixed.P(d.X, d.Y+face.Ascent)
+		drawer.DrawString(text)
+	}
+	drawer.Src = image.White
+	drawer.Dot = fixed.P(1, 1+face.Ascent)
+	drawer.DrawString(text)
+	return out
+}
+
+/*
+Returns the image with the watermark, or the image itself if there is no watermark.
+The watermark is scaled to the -watermark-scale of the image width.
+ */
+func addWatermark(img image.Image) image.Image {
+	if watermark == nil {
+		return img
+	}
+	b := img.Bounds()
+	width := maxInt(1, int(math.Round(float64(b.Dx())*watermarkScale)))
+	mark := imaging.Resize(watermark, width, 0, imaging.CatmullRom)
+	mb := mark.Bounds()
+
+	margin := int(math.Round(float64(minInt(b.Dx(), b.Dy())) * watermarkMargin))
+	x := map[byte]int{'l': margin, 'c': (b.Dx() - mb.Dx()) / 2, 'r': b.Dx() - mb.Dx() - margin}
+	y := map[byte]int{'t': margin, 'c': (b.Dy() - mb.Dy()) / 2, 'b': b.Dy() - mb.Dy() - margin}
+	horizontal, vertical := byte('c'), byte('c')
+	for _, part := range strings.Split(watermarkPosition, "-") {
+		switch part {
+		case "top", "bottom":
+			vertical = part[0]
+		case "left", "right":
+			horizontal = part[0]
+		}
+	}
+	return imaging.Overlay(img, mark, image.Pt(b.Min.X+x[horizontal], b.Min.Y+y[vertical]), watermarkOpacity)
+}
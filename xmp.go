@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/rwcarlsen/goexif/exif"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+var xmpMaxOffset int64 = 1 << 20 // XMP packet is searched for only in the beginning of the file
+
+var xmpPacketRe = regexp.MustCompile(`(?s)<x:xmpmeta.*?</x:xmpmeta>`)
+var xmpRatingRe = regexp.MustCompile(`xmp:Rating(?:="|>)\s*(-?[0-9]+)`)
+var xmpSubjectRe = regexp.MustCompile(`(?s)<dc:subject>\s*<rdf:Bag>(.*?)</rdf:Bag>`)
+var xmpListItemRe = regexp.MustCompile(`(?s)<rdf:li[^>]*>(.*?)</rdf:li>`)
+
+const exifRatingTag = 0x4746
+
+/*
+Loads rating and keywords of the image from its EXIF (Rating, XPKeywords) and XMP packet (xmp:Rating, dc:subject).
+XMP has a higher priority.
+ */
+func (i *imagePlacemark) loadRatingAndKeywords(filepath string) error {
+	if i.origExif != nil {
+		if len(i.origExif.Tiff.Dirs) > 0 {
+			for _, tag := range i.origExif.Tiff.Dirs[0].Tags {
+				if tag.Id == exifRatingTag {
+					if r, err := tag.Int(0); err == nil {
+						i.rating = r
+						i.hasRating = true
+					}
+				}
+			}
+		}
+		if tag, err := i.origExif.Get(exif.XPKeywords); err == nil {
+			i.keywords = splitKeywords(decodeUtf16le(tag.Val))
+		}
+	}
+
+	file, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	head, err := ioutil.ReadAll(io.LimitReader(file, xmpMaxOffset))
+	if err != nil {
+		return err
+	}
+
+	packet := xmpPacketRe.Find(head)
+	if packet == nil {
+		return nil
+	}
+	if m := xmpRatingRe.FindSubmatch(packet); m != nil {
+		if r, err := strconv.Atoi(string(m[1])); err == nil {
+			i.rating = r
+			i.hasRating = true
+		}
+	}
+	if m := xmpSubjectRe.FindSubmatch(packet); m != nil {
+		i.keywords = nil
+		for _, li := range xmpListItemRe.FindAllSubmatch(m[1], -1) {
+			i.keywords = append(i.keywords, strings.TrimSpace(html.UnescapeString(string(li[1]))))
+		}
+	}
+	return nil
+}
+
+/*
+Decodes a null-terminated UTF-16 little endian string (used by the Windows XP EXIF tags).
+ */
+func decodeUtf16le(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for n := 0; n+1 < len(b); n += 2 {
+		c := uint16(b[n]) | uint16(b[n+1])<<8
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+/*
+Splits keywords separated by semicolons.
+ */
+func splitKeywords(s string) []string {
+	var keywords []string
+	for _, k := range strings.Split(s, ";") {
+		if k = strings.TrimSpace(k); k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+	return keywords
+}
@@ -1,57 +1,115 @@
-/*
-Credits to stackoverflow.com user letigre (answer https://stackoverflow.com/a/49233329).
-I've modified their code.
- */
-
 package main
 
 import (
 	"archive/zip"
-	"io/ioutil"
+	"errors"
+	"io"
 	"os"
+	filepath2 "path/filepath"
+	"strings"
+	"time"
 )
 
-func zipFolderContents(folder, out string) {
-	// Get a Buffer to Write To
-	outFile, err := os.Create(out)
-	printIfErr(err)
-	defer outFile.Close()
+// timestamp of all KMZ entries (the earliest time a zip file can hold), so that the same build gives the same file
+var kmzTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
 
-	// Create a new zip archive.
-	w := zip.NewWriter(outFile)
+// extensions of already compressed files, which are stored in the KMZ without compression
+var kmzStoredExts = []string{"jpg", "jpeg", "jpe", "jif", "jfif", "jfi", "png", "gif", "heif", "heic"}
 
-	// Add some files to the archive.
-	addFiles(w, normalizePath(folder)+"/", "", out)
+/*
+Writes a KMZ file entry by entry: doc.kml first, then the files streamed from their current location.
+The file is written under a temporary name and renamed when it is complete.
+ */
+type kmzWriter struct {
+	path    string // the KMZ file
+	file    *os.File
+	zip     *zip.Writer
+	entries map[string]bool
+}
 
-	// Make sure to check the error on Close.
-	printIfErr(w.Close())
+/*
+Creates the KMZ file (see kmzWriter). Parent dirs are created if required.
+ */
+func createKmz(path string) (*kmzWriter, error) {
+	f, err := createFile(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	addCleanup(func() {
+		os.Remove(path + ".tmp") // if it is not complete
+	})
+	return &kmzWriter{path: path, file: f, zip: zip.NewWriter(f), entries: map[string]bool{}}, nil
+}
+
+/*
+Starts an entry with the compression method and returns its writer.
+ */
+func (k *kmzWriter) create(name string, method uint16) (io.Writer, error) {
+	k.entries[name] = true
+	return k.zip.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: kmzTime})
+}
+
+/*
+Writes the KML document as doc.kml. It has to be the first entry, as Google Earth opens the first KML file
+of the archive.
+ */
+func (k *kmzWriter) addKml(content []byte) error {
+	if len(k.entries) > 0 {
+		return errors.New("doc.kml has to be the first entry of the KMZ file")
+	}
+	w, err := k.create("doc.kml", zip.Deflate)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
 }
 
-func addFiles(w *zip.Writer, basePath, baseInZip, outFileToSkip string) {
-	// Open the Directory
-	files, err := ioutil.ReadDir(basePath)
-	printIfErr(err)
-
-	for _, file := range files {
-		//fmt.Println(basePath + file.Name())
-		if !file.IsDir() {
-			// skip the output zip file
-			if basePath + file.Name() == outFileToSkip {
-				continue
-			}
-
-			dat, err := ioutil.ReadFile(basePath + file.Name())
-			printIfErr(err)
-
-			// Add file to the archive.
-			f, err := w.Create(baseInZip + file.Name())
-			printIfErr(err)
-			_, err = f.Write(dat)
-			printIfErr(err)
-		} else if file.IsDir() {
-			// Recurse
-			newBase := basePath + file.Name() + "/"
-			addFiles(w, newBase, baseInZip  + file.Name() + "/", outFileToSkip)
-		}
-	}
-}
\ No newline at end of file
+/*
+Streams the file into the entry with the name. Already compressed images are stored, other files are deflated.
+Nothing is done if the entry already exists.
+ */
+func (k *kmzWriter) addFile(name, src string) error {
+	if k.entries[name] {
+		return nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return k.addReader(name, f)
+}
+
+/*
+Streams the reader into the entry with the name (see addFile).
+ */
+func (k *kmzWriter) addReader(name string, r io.Reader) error {
+	if k.entries[name] {
+		return nil
+	}
+	method := zip.Deflate
+	if containsString(kmzStoredExts, strings.ToLower(strings.TrimPrefix(filepath2.Ext(name), "."))) {
+		method = zip.Store
+	}
+	w, err := k.create(name, method)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+/*
+Finishes the KMZ file and moves it to its path.
+ */
+func (k *kmzWriter) close() error {
+	err := k.zip.Close()
+	if closeErr := k.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(k.path+".tmp", k.path)
+}